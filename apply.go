@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoDB collection where we keep previous values of all thresholds which we changed
+const thresholds_audit_collection_name = "baseline_exporter_thresholds_audit"
+
+// Change of single threshold in hostgroup
+type ThresholdChange struct {
+	Hostgroup     string `bson:"hostgroup" json:"hostgroup"`
+	Threshold     string `bson:"threshold" json:"threshold"`
+	PreviousValue uint   `bson:"previous_value" json:"previous_value"`
+	NewValue      uint   `bson:"new_value" json:"new_value"`
+}
+
+// Record about one apply or rollback run
+type ThresholdsAuditEntry struct {
+	RunId     string `bson:"run_id" json:"run_id"`
+	Operation string `bson:"operation" json:"operation"`
+
+	// For rollback it's run which we rolled back
+	RolledBackRunId string `bson:"rolled_back_run_id,omitempty" json:"rolled_back_run_id,omitempty"`
+
+	// For apply it's rollback run which restored previous values
+	RolledBackBy string `bson:"rolled_back_by,omitempty" json:"rolled_back_by,omitempty"`
+
+	CreatedAt       time.Time         `bson:"created_at" json:"created_at"`
+	ExporterVersion string            `bson:"exporter_version" json:"exporter_version"`
+	Changes         []ThresholdChange `bson:"changes" json:"changes"`
+}
+
+// Returns pointer to threshold field of hostgroup by its name in MongoDB or nil when we do not have such threshold
+func (ban_settings *Ban_settings_t) threshold_field(threshold string) *uint {
+	if !strings.HasPrefix(threshold, "threshold_") {
+		return nil
+	}
+
+	settings_value := reflect.ValueOf(ban_settings).Elem()
+
+	for index := 0; index < settings_value.NumField(); index++ {
+		if settings_value.Type().Field(index).Tag.Get("bson") != threshold {
+			continue
+		}
+
+		field, ok := settings_value.Field(index).Addr().Interface().(*uint)
+
+		if !ok {
+			return nil
+		}
+
+		return field
+	}
+
+	return nil
+}
+
+// Compares thresholds of hostgroup with recommendations and returns list of changes
+func calculate_threshold_changes(host_group Ban_settings_t, recommendations *RecommendationsStructure) []ThresholdChange {
+	changes := []ThresholdChange{}
+
+	for _, recommendation := range recommendations.Thresholds {
+		current_value := host_group.threshold_field(recommendation.Threshold)
+
+		if current_value == nil {
+			fast_logger.Printf("Hostgroup configuration has no threshold %s, skip it", recommendation.Threshold)
+			continue
+		}
+
+		if recommendation.Value < 0 || uint(recommendation.Value) == *current_value {
+			continue
+		}
+
+		changes = append(changes, ThresholdChange{
+			Hostgroup:     host_group.Name,
+			Threshold:     recommendation.Threshold,
+			PreviousValue: *current_value,
+			NewValue:      uint(recommendation.Value),
+		})
+	}
+
+	return changes
+}
+
+// Prints changes as table
+func print_threshold_changes(output io.Writer, changes []ThresholdChange) {
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(table, "Hostgroup\tThreshold\tCurrent\tNew\n")
+
+	for _, change := range changes {
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\n", change.Hostgroup, change.Threshold, change.PreviousValue, change.NewValue)
+	}
+
+	table.Flush()
+}
+
+// Asks user about every change and returns only approved ones
+// Answer a approves this and all following changes, q rejects this and all following changes
+func approve_threshold_changes(input *bufio.Reader, output io.Writer, changes []ThresholdChange) []ThresholdChange {
+	approved_changes := []ThresholdChange{}
+
+	for index, change := range changes {
+		fmt.Fprintf(output, "%s: change %s from %d to %d? [y/N/a/q] ", change.Hostgroup, change.Threshold, change.PreviousValue, change.NewValue)
+
+		answer, err := input.ReadString('\n')
+
+		if err != nil && answer == "" {
+			// We treat closed stdin as rejection
+			fmt.Fprintln(output)
+			return approved_changes
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			approved_changes = append(approved_changes, change)
+		case "a", "all":
+			return append(approved_changes, changes[index:]...)
+		case "q", "quit":
+			return approved_changes
+		}
+	}
+
+	return approved_changes
+}
+
+// Asks single yes or no question
+func confirm(input *bufio.Reader, output io.Writer, question string) bool {
+	fmt.Fprintf(output, "%s [y/N] ", question)
+
+	answer, _ := input.ReadString('\n')
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+// Writes new values of thresholds into hostgroups_configuration
+func write_threshold_changes(ctx context.Context, mongo_client *mongo.Client, changes []ThresholdChange) error {
+	hostgroups_collection := mongo_client.Database(global_db_conf.Db_name).Collection("hostgroups_configuration")
+
+	// We update every hostgroup once
+	updates := map[string]bson.D{}
+	hostgroup_names := []string{}
+
+	for _, change := range changes {
+		if _, ok := updates[change.Hostgroup]; !ok {
+			hostgroup_names = append(hostgroup_names, change.Hostgroup)
+		}
+
+		updates[change.Hostgroup] = append(updates[change.Hostgroup], bson.E{Key: change.Threshold, Value: change.NewValue})
+	}
+
+	for _, hostgroup_name := range hostgroup_names {
+		result, err := hostgroups_collection.UpdateOne(ctx, bson.D{{Key: "name", Value: hostgroup_name}}, bson.D{{Key: "$set", Value: updates[hostgroup_name]}})
+
+		if err != nil {
+			return fmt.Errorf("Cannot update hostgroup %s: %w", hostgroup_name, err)
+		}
+
+		if result.MatchedCount == 0 {
+			return fmt.Errorf("Hostgroup %s disappeared from MongoDB", hostgroup_name)
+		}
+	}
+
+	return nil
+}
+
+// Stores audit entry for apply or rollback run
+func insert_thresholds_audit_entry(ctx context.Context, mongo_client *mongo.Client, entry *ThresholdsAuditEntry) error {
+	audit_collection := mongo_client.Database(global_db_conf.Db_name).Collection(thresholds_audit_collection_name)
+
+	_, err := audit_collection.InsertOne(ctx, entry)
+
+	return err
+}
+
+// Reads audit entry by run id
+func read_thresholds_audit_entry(ctx context.Context, mongo_client *mongo.Client, run_id string) (*ThresholdsAuditEntry, error) {
+	audit_collection := mongo_client.Database(global_db_conf.Db_name).Collection(thresholds_audit_collection_name)
+
+	entry := &ThresholdsAuditEntry{}
+
+	err := audit_collection.FindOne(ctx, bson.D{{Key: "run_id", Value: run_id}}).Decode(entry)
+
+	if err == mongo.ErrNoDocuments {
+		return nil, fmt.Errorf("We have no run %s in %s", run_id, thresholds_audit_collection_name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Records audit entry and writes changes into hostgroups_configuration
+// We store previous values before any change to be able to roll back partially applied run
+func apply_threshold_changes(ctx context.Context, mongo_client *mongo.Client, entry *ThresholdsAuditEntry) error {
+	err := insert_thresholds_audit_entry(ctx, mongo_client, entry)
+
+	if err != nil {
+		return fmt.Errorf("Cannot store previous values of thresholds: %w", err)
+	}
+
+	return write_threshold_changes(ctx, mongo_client, entry.Changes)
+}
+
+// Copies recommended thresholds into hostgroups configuration after approval
+func apply_command(arguments []string) int {
+	flag_set := new_command_flag_set("apply", "[hostgroup]")
+	approve_all := flag_set.Bool("yes", false, "Apply all changes without approval")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() > 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	host_groups, err := read_hostgroups(ctx, new_mongodb_storage(mongo_client), nil)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	changes := []ThresholdChange{}
+	found_hostgroup := false
+
+	for _, host_group := range host_groups {
+		if flag_set.NArg() == 1 && host_group.Name != flag_set.Arg(0) {
+			continue
+		}
+
+		found_hostgroup = true
+
+		recommendations := &RecommendationsStructure{}
+
+		found, err := read_document_by_name(ctx, mongo_client, hostgroups_recommendations_collection_name, host_group.Name, recommendations)
+
+		if err != nil {
+			fast_logger.Printf("Cannot read threshold recommendations for %s: %v", host_group.Name, err)
+			return 1
+		}
+
+		if !found {
+			fast_logger.Printf("We have no threshold recommendations for %s, skip it", host_group.Name)
+			continue
+		}
+
+		changes = append(changes, calculate_threshold_changes(host_group, recommendations)...)
+	}
+
+	if !found_hostgroup {
+		fast_logger.Printf("We have no hostgroup %s", flag_set.Arg(0))
+		return 1
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("All thresholds match recommendations")
+		return 0
+	}
+
+	print_threshold_changes(os.Stdout, changes)
+
+	if !*approve_all {
+		changes = approve_threshold_changes(bufio.NewReader(os.Stdin), os.Stdout, changes)
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("No changes approved")
+		return 0
+	}
+
+	entry := &ThresholdsAuditEntry{
+		RunId:           primitive.NewObjectID().Hex(),
+		Operation:       "apply",
+		CreatedAt:       time.Now(),
+		ExporterVersion: exporter_version,
+		Changes:         changes,
+	}
+
+	err = apply_threshold_changes(ctx, mongo_client, entry)
+
+	if err != nil {
+		fast_logger.Printf("Cannot apply thresholds in run %s: %v", entry.RunId, err)
+		return 1
+	}
+
+	fast_logger.Printf("Applied %d threshold changes in run %s", len(changes), entry.RunId)
+	fmt.Printf("Applied %d changes, run id %s\n", len(changes), entry.RunId)
+
+	return 0
+}
+
+// Restores values of thresholds which we changed in specified apply run
+func rollback_command(arguments []string) int {
+	flag_set := new_command_flag_set("rollback", "<run-id>")
+	approve_all := flag_set.Bool("yes", false, "Roll back without approval")
+	force := flag_set.Bool("force", false, "Restore thresholds which were changed after this run and roll back run again")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() != 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	applied_entry, err := read_thresholds_audit_entry(ctx, mongo_client, flag_set.Arg(0))
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	if applied_entry.Operation != "apply" {
+		fast_logger.Printf("Run %s is %s, we can roll back only apply runs", applied_entry.RunId, applied_entry.Operation)
+		return 1
+	}
+
+	if applied_entry.RolledBackBy != "" && !*force {
+		fast_logger.Printf("Run %s was already rolled back by run %s", applied_entry.RunId, applied_entry.RolledBackBy)
+		return 1
+	}
+
+	host_groups, err := read_hostgroups(ctx, new_mongodb_storage(mongo_client), nil)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	changes := []ThresholdChange{}
+
+	for _, applied_change := range applied_entry.Changes {
+		var current_value *uint
+
+		for index := range host_groups {
+			if host_groups[index].Name == applied_change.Hostgroup {
+				current_value = host_groups[index].threshold_field(applied_change.Threshold)
+			}
+		}
+
+		if current_value == nil {
+			fast_logger.Printf("We have no threshold %s in hostgroup %s anymore, skip it", applied_change.Threshold, applied_change.Hostgroup)
+			continue
+		}
+
+		// Someone changed threshold after us and we do not want to override it silently
+		if *current_value != applied_change.NewValue && !*force {
+			fast_logger.Printf("Threshold %s in hostgroup %s was changed to %d after run %s, skip it", applied_change.Threshold, applied_change.Hostgroup, *current_value, applied_entry.RunId)
+			continue
+		}
+
+		if *current_value == applied_change.PreviousValue {
+			continue
+		}
+
+		changes = append(changes, ThresholdChange{
+			Hostgroup:     applied_change.Hostgroup,
+			Threshold:     applied_change.Threshold,
+			PreviousValue: *current_value,
+			NewValue:      applied_change.PreviousValue,
+		})
+	}
+
+	if len(changes) == 0 {
+		fmt.Println("Nothing to roll back")
+		return 0
+	}
+
+	print_threshold_changes(os.Stdout, changes)
+
+	if !*approve_all && !confirm(bufio.NewReader(os.Stdin), os.Stdout, "Roll back these changes?") {
+		fmt.Println("Rollback cancelled")
+		return 0
+	}
+
+	entry := &ThresholdsAuditEntry{
+		RunId:           primitive.NewObjectID().Hex(),
+		Operation:       "rollback",
+		RolledBackRunId: applied_entry.RunId,
+		CreatedAt:       time.Now(),
+		ExporterVersion: exporter_version,
+		Changes:         changes,
+	}
+
+	err = apply_threshold_changes(ctx, mongo_client, entry)
+
+	if err != nil {
+		fast_logger.Printf("Cannot roll back run %s: %v", applied_entry.RunId, err)
+		return 1
+	}
+
+	audit_collection := mongo_client.Database(global_db_conf.Db_name).Collection(thresholds_audit_collection_name)
+
+	_, err = audit_collection.UpdateOne(ctx, bson.D{{Key: "run_id", Value: applied_entry.RunId}}, bson.D{{Key: "$set", Value: bson.D{{Key: "rolled_back_by", Value: entry.RunId}}}})
+
+	if err != nil {
+		fast_logger.Printf("Cannot mark run %s as rolled back: %v", applied_entry.RunId, err)
+	}
+
+	fast_logger.Printf("Rolled back %d threshold changes of run %s in run %s", len(changes), applied_entry.RunId, entry.RunId)
+	fmt.Printf("Rolled back %d changes, run id %s\n", len(changes), entry.RunId)
+
+	return 0
+}
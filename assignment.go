@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"text/tabwriter"
+)
+
+// Network of hostgroup which we use for assignment of hosts
+type hostgroup_network struct {
+	hostgroup string
+
+	// Position of hostgroup in list, FastNetMon picks first hostgroup when they have same network
+	hostgroup_index int
+
+	network *net.IPNet
+}
+
+// Two networks from different hostgroups which cover same hosts
+type NetworkOverlap struct {
+	Hostgroup         string `json:"hostgroup"`
+	Network           string `json:"network"`
+	OtherHostgroup    string `json:"other_hostgroup"`
+	OtherNetwork      string `json:"other_network"`
+	Relation          string `json:"relation"`
+	AssignedHostgroup string `json:"assigned_hostgroup"`
+}
+
+// WHERE clauses for all hostgroups which select only hosts which belong to hostgroup
+var hostgroup_where_clauses = map[string]built_query{}
+
+// Returns true when network is more specific than other network and inside it
+func is_network_inside(network *net.IPNet, other_network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	other_ones, other_bits := other_network.Mask.Size()
+
+	return bits == other_bits && ones > other_ones && other_network.Contains(network.IP)
+}
+
+// Returns true when networks are same
+func is_same_network(network *net.IPNet, other_network *net.IPNet) bool {
+	return network.IP.Equal(other_network.IP) && bytes.Equal(network.Mask, other_network.Mask)
+}
+
+// Returns true when list has same network
+func network_in_list(network *net.IPNet, networks []*net.IPNet) bool {
+	for _, other_network := range networks {
+		if is_same_network(network, other_network) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parses networks of all hostgroups, we skip networks with bad format
+func parse_hostgroup_networks(host_groups []Ban_settings_t) []hostgroup_network {
+	networks := []hostgroup_network{}
+
+	for index, host_group := range host_groups {
+		for _, network_string := range host_group.Networks {
+			_, network, err := net.ParseCIDR(network_string)
+
+			if err != nil {
+				continue
+			}
+
+			networks = append(networks, hostgroup_network{hostgroup: host_group.Name, hostgroup_index: index, network: network})
+		}
+	}
+
+	return networks
+}
+
+// Returns true when host from network goes to other network according to longest prefix match
+func is_network_taken_by(network hostgroup_network, other_network hostgroup_network) bool {
+	if network.hostgroup == other_network.hostgroup {
+		return false
+	}
+
+	if is_network_inside(other_network.network, network.network) {
+		return true
+	}
+
+	return is_same_network(other_network.network, network.network) && other_network.hostgroup_index < network.hostgroup_index
+}
+
+// Calculates WHERE clauses which assign every host to single hostgroup like FastNetMon does
+// Host belongs to hostgroup with longest matching prefix and hostgroups without networks get only hosts which do not belong to any other hostgroup
+// We subtract networks taken by other hostgroups from networks of hostgroup and select hosts by remaining ranges of addresses
+func calculate_hostgroup_where_clauses(host_groups []Ban_settings_t) map[string]built_query {
+	networks := parse_hostgroup_networks(host_groups)
+	where_clauses := map[string]built_query{}
+
+	all_ranges := []address_range{}
+
+	for _, network := range networks {
+		all_ranges = append(all_ranges, network_address_range(network.network))
+	}
+
+	// Same network can be present in many hostgroups
+	all_ranges = merge_address_ranges(all_ranges)
+
+	for _, host_group := range host_groups {
+		if len(host_group.Networks) == 0 {
+			if len(all_ranges) == 0 {
+				where_clauses[host_group.Name] = query_text("1 = 1")
+			} else {
+				where_clauses[host_group.Name] = format_query("NOT (%s)", generate_address_ranges_condition(all_ranges))
+			}
+
+			continue
+		}
+
+		hostgroup_ranges := []address_range{}
+		parsed_networks := 0
+
+		for _, network := range networks {
+			if network.hostgroup != host_group.Name {
+				continue
+			}
+
+			parsed_networks++
+
+			taken_ranges := []address_range{}
+
+			for _, other_network := range networks {
+				if is_network_taken_by(network, other_network) {
+					taken_ranges = append(taken_ranges, network_address_range(other_network.network))
+				}
+			}
+
+			hostgroup_ranges = append(hostgroup_ranges, subtract_address_ranges([]address_range{network_address_range(network.network)}, merge_address_ranges(taken_ranges))...)
+		}
+
+		// We keep previous behaviour when we cannot parse any network
+		if parsed_networks == 0 {
+			continue
+		}
+
+		where_clauses[host_group.Name] = generate_address_ranges_condition(merge_address_ranges(hostgroup_ranges))
+	}
+
+	return where_clauses
+}
+
+// Returns WHERE clause which selects hosts of hostgroup
+// We use longest prefix assignment when we know all hostgroups and plain list of networks otherwise
+func generate_hostgroup_where_clause(hostgroup_name string, networks_list []string) built_query {
+	where_clause, ok := hostgroup_where_clauses[hostgroup_name]
+
+	if ok {
+		return where_clause
+	}
+
+	return generate_network_where_clause(networks_list)
+}
+
+// Finds networks from different hostgroups which cover same hosts
+func find_network_overlaps(host_groups []Ban_settings_t) []NetworkOverlap {
+	networks := parse_hostgroup_networks(host_groups)
+	overlaps := []NetworkOverlap{}
+
+	for index, network := range networks {
+		for _, other_network := range networks[index+1:] {
+			if network.hostgroup == other_network.hostgroup {
+				continue
+			}
+
+			overlap := NetworkOverlap{
+				Hostgroup:      network.hostgroup,
+				Network:        network.network.String(),
+				OtherHostgroup: other_network.hostgroup,
+				OtherNetwork:   other_network.network.String(),
+			}
+
+			if is_same_network(network.network, other_network.network) {
+				overlap.Relation = "same"
+				overlap.AssignedHostgroup = network.hostgroup
+			} else if is_network_inside(other_network.network, network.network) {
+				overlap.Relation = "contains"
+				overlap.AssignedHostgroup = other_network.hostgroup
+			} else if is_network_inside(network.network, other_network.network) {
+				overlap.Relation = "inside"
+				overlap.AssignedHostgroup = network.hostgroup
+			} else {
+				continue
+			}
+
+			overlaps = append(overlaps, overlap)
+		}
+	}
+
+	return overlaps
+}
+
+// Prints overlapping networks of hostgroups
+func show_overlaps_command(arguments []string) int {
+	flag_set := new_command_flag_set("show-overlaps", "")
+	format := flag_set.String("format", "table", "Output format: table or json")
+	flag_set.Parse(arguments)
+
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, we support table and json\n", *format)
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	host_groups, err := read_hostgroups(ctx, new_mongodb_storage(mongo_client), nil)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	overlaps := find_network_overlaps(host_groups)
+
+	if *format == "json" {
+		return print_json(overlaps)
+	}
+
+	print_network_overlaps(os.Stdout, overlaps)
+
+	return 0
+}
+
+// Prints overlapping networks as table
+func print_network_overlaps(output io.Writer, overlaps []NetworkOverlap) {
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(table, "Hostgroup\tNetwork\tRelation\tOther hostgroup\tOther network\tHosts go to\n")
+
+	for _, overlap := range overlaps {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", overlap.Hostgroup, overlap.Network, overlap.Relation, overlap.OtherHostgroup, overlap.OtherNetwork, overlap.AssignedHostgroup)
+	}
+
+	table.Flush()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCalculateHostgroupWhereClauses(t *testing.T) {
+	test_cases := []struct {
+		name        string
+		host_groups []Ban_settings_t
+		expected    map[string]string
+	}{
+		{
+			name: "nested prefixes go to longest prefix",
+			host_groups: []Ban_settings_t{
+				{Name: "customers", Networks: []string{"10.0.0.0/8"}},
+				{Name: "vip", Networks: []string{"10.1.0.0/16"}},
+				{Name: "vip_host", Networks: []string{"10.1.2.3/32"}},
+			},
+			expected: map[string]string{
+				"customers": "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.0.255.255')) OR (toIPv4(host) BETWEEN toIPv4('10.2.0.0') AND toIPv4('10.255.255.255'))))",
+				"vip":       "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.1.0.0') AND toIPv4('10.1.2.2')) OR (toIPv4(host) BETWEEN toIPv4('10.1.2.4') AND toIPv4('10.1.255.255'))))",
+				"vip_host":  "(position(host, ':') = 0 AND (toIPv4(host) = toIPv4('10.1.2.3')))",
+			},
+		},
+		{
+			name: "equal prefixes go to first hostgroup",
+			host_groups: []Ban_settings_t{
+				{Name: "first", Networks: []string{"10.0.0.0/24", "10.0.1.0/24"}},
+				{Name: "second", Networks: []string{"10.0.0.0/24"}},
+			},
+			expected: map[string]string{
+				"first":  "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.0.1.255'))))",
+				"second": "1 = 0",
+			},
+		},
+		{
+			name: "mixed families",
+			host_groups: []Ban_settings_t{
+				{Name: "customers", Networks: []string{"10.0.0.0/8", "2001:db8::/32"}},
+				{Name: "vip", Networks: []string{"2001:db8:1::/48"}},
+			},
+			expected: map[string]string{
+				"customers": "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.255.255.255')))) OR " +
+					"(position(host, ':') > 0 AND ((toIPv6(host) BETWEEN toIPv6('2001:db8::') AND toIPv6('2001:db8:0:ffff:ffff:ffff:ffff:ffff')) OR " +
+					"(toIPv6(host) BETWEEN toIPv6('2001:db8:2::') AND toIPv6('2001:db8:ffff:ffff:ffff:ffff:ffff:ffff'))))",
+				"vip": "(position(host, ':') > 0 AND ((toIPv6(host) BETWEEN toIPv6('2001:db8:1::') AND toIPv6('2001:db8:1:ffff:ffff:ffff:ffff:ffff'))))",
+			},
+		},
+		{
+			name: "global hostgroup gets hosts outside of all networks",
+			host_groups: []Ban_settings_t{
+				{Name: "global"},
+				{Name: "customers", Networks: []string{"10.0.0.0/24", "10.0.1.0/24"}},
+				{Name: "vip", Networks: []string{"10.0.0.0/25", "2001:db8::/32"}},
+			},
+			expected: map[string]string{
+				"global": "NOT ((position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.0.1.255')))) OR " +
+					"(position(host, ':') > 0 AND ((toIPv6(host) BETWEEN toIPv6('2001:db8::') AND toIPv6('2001:db8:ffff:ffff:ffff:ffff:ffff:ffff')))))",
+				"customers": "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.128') AND toIPv4('10.0.1.255'))))",
+				"vip": "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.0.0.127')))) OR " +
+					"(position(host, ':') > 0 AND ((toIPv6(host) BETWEEN toIPv6('2001:db8::') AND toIPv6('2001:db8:ffff:ffff:ffff:ffff:ffff:ffff'))))",
+			},
+		},
+		{
+			name:        "global hostgroup without other networks gets everything",
+			host_groups: []Ban_settings_t{{Name: "global"}},
+			expected:    map[string]string{"global": "1 = 1"},
+		},
+	}
+
+	for _, test_case := range test_cases {
+		configuration = BaselineExporterConfiguration{NetworkTableThreshold: 1000}
+
+		where_clauses := calculate_hostgroup_where_clauses(test_case.host_groups)
+
+		if len(where_clauses) != len(test_case.expected) {
+			t.Errorf("%s: expected clauses for %d hostgroups, we have %d", test_case.name, len(test_case.expected), len(where_clauses))
+		}
+
+		for hostgroup_name, expected := range test_case.expected {
+			if where_clause := where_clauses[hostgroup_name].inlined(); where_clause != expected {
+				t.Errorf("%s: hostgroup %s must have\n%s\nwe have\n%s", test_case.name, hostgroup_name, expected, where_clause)
+			}
+		}
+	}
+}
+
+func TestHostgroupWhereClauseFallback(t *testing.T) {
+	configuration = BaselineExporterConfiguration{NetworkTableThreshold: 1000}
+
+	// Hostgroup with all networks invalid has no clause and must select nothing instead of all hosts
+	hostgroup_where_clauses = calculate_hostgroup_where_clauses([]Ban_settings_t{
+		{Name: "broken", Networks: []string{"10.0.0.0/33"}},
+		{Name: "customers", Networks: []string{"10.0.0.0/8"}},
+	})
+
+	defer func() {
+		hostgroup_where_clauses = map[string]built_query{}
+	}()
+
+	if _, ok := hostgroup_where_clauses["broken"]; ok {
+		t.Errorf("Hostgroup without valid networks must not have clause")
+	}
+
+	test_cases := []struct {
+		hostgroup string
+		networks  []string
+		expected  string
+	}{
+		{"broken", []string{"10.0.0.0/33"}, "1 = 0"},
+		{"unknown", []string{}, "1 = 1"},
+		{"customers", []string{"10.0.0.0/8"}, "(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.255.255.255'))))"},
+	}
+
+	for _, test_case := range test_cases {
+		if where_clause := generate_hostgroup_where_clause(test_case.hostgroup, test_case.networks).inlined(); where_clause != test_case.expected {
+			t.Errorf("Hostgroup %s must have %s, we have %s", test_case.hostgroup, test_case.expected, where_clause)
+		}
+	}
+}
+
+func TestFindNetworkOverlaps(t *testing.T) {
+	overlaps := find_network_overlaps([]Ban_settings_t{
+		{Name: "customers", Networks: []string{"10.0.0.0/8", "192.0.2.0/24", "2001:db8::/32"}},
+		{Name: "vip", Networks: []string{"10.1.0.0/16", "192.0.2.0/24", "10.0.0.0/33"}},
+		{Name: "uplink", Networks: []string{"0.0.0.0/0", "2001:db8:1::/48"}},
+	})
+
+	expected := []NetworkOverlap{
+		{Hostgroup: "customers", Network: "10.0.0.0/8", OtherHostgroup: "vip", OtherNetwork: "10.1.0.0/16", Relation: "contains", AssignedHostgroup: "vip"},
+		{Hostgroup: "customers", Network: "10.0.0.0/8", OtherHostgroup: "uplink", OtherNetwork: "0.0.0.0/0", Relation: "inside", AssignedHostgroup: "customers"},
+		{Hostgroup: "customers", Network: "192.0.2.0/24", OtherHostgroup: "vip", OtherNetwork: "192.0.2.0/24", Relation: "same", AssignedHostgroup: "customers"},
+		{Hostgroup: "customers", Network: "192.0.2.0/24", OtherHostgroup: "uplink", OtherNetwork: "0.0.0.0/0", Relation: "inside", AssignedHostgroup: "customers"},
+		{Hostgroup: "customers", Network: "2001:db8::/32", OtherHostgroup: "uplink", OtherNetwork: "2001:db8:1::/48", Relation: "contains", AssignedHostgroup: "uplink"},
+		{Hostgroup: "vip", Network: "10.1.0.0/16", OtherHostgroup: "uplink", OtherNetwork: "0.0.0.0/0", Relation: "inside", AssignedHostgroup: "vip"},
+		{Hostgroup: "vip", Network: "192.0.2.0/24", OtherHostgroup: "uplink", OtherNetwork: "0.0.0.0/0", Relation: "inside", AssignedHostgroup: "vip"},
+	}
+
+	if len(overlaps) != len(expected) {
+		t.Fatalf("Expected %d overlaps, we have %d: %+v", len(expected), len(overlaps), overlaps)
+	}
+
+	for index := range expected {
+		if overlaps[index] != expected[index] {
+			t.Errorf("Overlap %d must be %+v, we have %+v", index, expected[index], overlaps[index])
+		}
+	}
+}
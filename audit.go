@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Threshold which is lower than normal traffic or too close to it
+type ThresholdAuditFinding struct {
+	Hostgroup string `json:"hostgroup"`
+	Threshold string `json:"threshold"`
+	Metric    string `json:"metric"`
+	Direction string `json:"direction"`
+	Statistic string `json:"statistic"`
+	Unit      string `json:"unit"`
+
+	ThresholdValue uint `json:"threshold_value"`
+
+	// Baseline in units of threshold
+	BaselineValue float64 `json:"baseline_value"`
+
+	// How much threshold is higher than baseline, negative when it's lower
+	HeadroomPercent float64 `json:"headroom_percent"`
+
+	// below_baseline or low_headroom
+	Status string `json:"status"`
+}
+
+// Compares configured thresholds of hostgroup with baseline
+// We check only thresholds which have rules and skip disabled (zero) thresholds
+func audit_hostgroup_thresholds(host_group Ban_settings_t, baseline *BaselineStructure, statistic *traffic_statistic, headroom_percent float64) []ThresholdAuditFinding {
+	findings := []ThresholdAuditFinding{}
+	checked_thresholds := map[string]bool{}
+
+	for _, rule := range configuration.ThresholdRules {
+		if checked_thresholds[rule.Threshold] {
+			continue
+		}
+
+		threshold_value := host_group.threshold_field(rule.Threshold)
+
+		if threshold_value == nil || *threshold_value == 0 {
+			continue
+		}
+
+		traffic_baseline := &baseline.Incoming
+
+		if rule.Direction == "outgoing" {
+			traffic_baseline = &baseline.Outgoing
+		}
+
+		traffic_value := traffic_baseline.value_by_metric(rule.Metric)
+
+		if traffic_value == nil {
+			continue
+		}
+
+		baseline_value, ok := statistic.get(traffic_value)
+
+		if !ok || baseline_value <= 0 {
+			continue
+		}
+
+		checked_thresholds[rule.Threshold] = true
+
+		unit := threshold_unit(rule.Metric)
+
+		baseline_in_threshold_units := float64(baseline_value)
+
+		if unit == "mbps" {
+			baseline_in_threshold_units = baseline_in_threshold_units / 1000000
+		}
+
+		finding := ThresholdAuditFinding{
+			Hostgroup:       host_group.Name,
+			Threshold:       rule.Threshold,
+			Metric:          rule.Metric,
+			Direction:       rule.Direction,
+			Statistic:       statistic.name,
+			Unit:            unit,
+			ThresholdValue:  *threshold_value,
+			BaselineValue:   baseline_in_threshold_units,
+			HeadroomPercent: (float64(*threshold_value) - baseline_in_threshold_units) / baseline_in_threshold_units * 100,
+		}
+
+		if finding.HeadroomPercent < 0 {
+			finding.Status = "below_baseline"
+		} else if finding.HeadroomPercent < headroom_percent {
+			finding.Status = "low_headroom"
+		} else {
+			continue
+		}
+
+		findings = append(findings, finding)
+	}
+
+	return findings
+}
+
+// Prints findings of threshold audit in table, json or csv format
+func print_threshold_audit(output io.Writer, format string, findings []ThresholdAuditFinding) error {
+	switch format {
+	case "json":
+		json_output, err := json.MarshalIndent(findings, "", "  ")
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(output, string(json_output))
+
+		return err
+	case "csv":
+		writer := csv.NewWriter(output)
+
+		writer.Write([]string{"hostgroup", "threshold", "metric", "direction", "statistic", "unit", "threshold_value", "baseline_value", "headroom_percent", "status"})
+
+		for _, finding := range findings {
+			writer.Write([]string{
+				finding.Hostgroup, finding.Threshold, finding.Metric, finding.Direction, finding.Statistic, finding.Unit,
+				strconv.FormatUint(uint64(finding.ThresholdValue), 10),
+				strconv.FormatFloat(finding.BaselineValue, 'f', 2, 64),
+				strconv.FormatFloat(finding.HeadroomPercent, 'f', 1, 64),
+				finding.Status,
+			})
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+	}
+
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(table, "Hostgroup\tThreshold\tValue\tBaseline\tHeadroom\tStatus\n")
+
+	for _, finding := range findings {
+		fmt.Fprintf(table, "%s\t%s\t%d %s\t%.2f %s (%s %s)\t%.1f%%\t%s\n", finding.Hostgroup, finding.Threshold, finding.ThresholdValue, finding.Unit,
+			finding.BaselineValue, finding.Unit, finding.Statistic, finding.Metric, finding.HeadroomPercent, finding.Status)
+	}
+
+	return table.Flush()
+}
+
+// Finds thresholds which are lower than freshly computed baselines or too close to them
+func audit_thresholds_command(arguments []string) int {
+	flag_set := new_command_flag_set("audit-thresholds", "[hostgroup]")
+	format := flag_set.String("format", "table", "Output format: table, json or csv")
+	statistic_name := flag_set.String("statistic", "p95", "Baseline statistic which we compare with thresholds")
+	headroom_percent := flag_set.Float64("headroom", -1, "Report thresholds which are less than this percentage above baseline, threshold_audit_headroom from configuration by default")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() > 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	if *format != "table" && *format != "json" && *format != "csv" {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, we support table, json and csv\n", *format)
+		return 2
+	}
+
+	statistic := find_statistic(*statistic_name)
+
+	if statistic == nil {
+		fmt.Fprintf(os.Stderr, "Unknown statistic %s\n", *statistic_name)
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	if *headroom_percent < 0 {
+		*headroom_percent = configuration.ThresholdAuditHeadroom
+	}
+
+	clickhouse_client, err := connect_to_clickhouse(ctx)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	defer clickhouse_client.Close()
+
+	host_groups, err := read_hostgroups(ctx, new_mongodb_storage(mongo_client), nil)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	statistics, err := configured_statistics()
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	calculated := false
+
+	for _, configured_statistic := range statistics {
+		if configured_statistic == statistic {
+			calculated = true
+		}
+	}
+
+	if !calculated {
+		statistics = append(statistics, statistic)
+	}
+
+	window := new_calculation_window(time.Now())
+
+	err = load_attack_exclusions(ctx, mongo_client, window)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	findings := []ThresholdAuditFinding{}
+	found_hostgroup := false
+
+	for _, host_group := range host_groups {
+		if flag_set.NArg() == 1 && host_group.Name != flag_set.Arg(0) {
+			continue
+		}
+
+		found_hostgroup = true
+
+		baseline, err := generate_baselines(ctx, host_group, clickhouse_client, statistics, window)
+
+		if err != nil {
+			fast_logger.Printf("Cannot generate baselines for %s with error %v", host_group.Name, err)
+			continue
+		}
+
+		findings = append(findings, audit_hostgroup_thresholds(host_group, baseline, statistic, *headroom_percent)...)
+	}
+
+	if !found_hostgroup {
+		fast_logger.Printf("We have no hostgroup %s", flag_set.Arg(0))
+		return 1
+	}
+
+	err = print_threshold_audit(os.Stdout, *format, findings)
+
+	if err != nil {
+		fast_logger.Printf("Cannot print report: %v", err)
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Threshold which we replay over historical traffic
+type backtest_threshold struct {
+	name      string
+	metric    string
+	direction string
+	value     uint
+}
+
+// Result of replaying single threshold for hostgroup
+type BacktestResult struct {
+	Hostgroup string `json:"hostgroup"`
+	Threshold string `json:"threshold"`
+	Value     uint   `json:"value"`
+	Unit      string `json:"unit"`
+	Metric    string `json:"metric"`
+	Direction string `json:"direction"`
+
+	// Number of hosts which exceeded threshold, for total hostgroups it's 1 when hostgroup exceeded it
+	Hosts int64 `json:"hosts"`
+
+	// Number of minutes when hosts exceeded threshold, summed over all hosts
+	Minutes int64 `json:"minutes"`
+
+	// Number of separate periods of exceeding, summed over all hosts
+	Events int64 `json:"events"`
+}
+
+// Returns enabled thresholds of hostgroup which have threshold rule
+func current_backtest_thresholds(host_group Ban_settings_t) []backtest_threshold {
+	thresholds := []backtest_threshold{}
+	added_thresholds := map[string]bool{}
+
+	for _, rule := range configuration.ThresholdRules {
+		threshold_value := host_group.threshold_field(rule.Threshold)
+
+		if threshold_value == nil || *threshold_value == 0 || added_thresholds[rule.Threshold] {
+			continue
+		}
+
+		added_thresholds[rule.Threshold] = true
+
+		thresholds = append(thresholds, backtest_threshold{name: rule.Threshold, metric: rule.Metric, direction: rule.Direction, value: *threshold_value})
+	}
+
+	return thresholds
+}
+
+// Returns recommended thresholds for hostgroup from MongoDB
+func recommended_backtest_thresholds(ctx context.Context, mongo_client *mongo.Client, host_group Ban_settings_t) ([]backtest_threshold, error) {
+	recommendations := &RecommendationsStructure{}
+
+	found, err := read_document_by_name(ctx, mongo_client, hostgroups_recommendations_collection_name, host_group.Name, recommendations)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return nil, fmt.Errorf("We have no threshold recommendations for %s", host_group.Name)
+	}
+
+	thresholds := []backtest_threshold{}
+
+	for _, recommendation := range recommendations.Thresholds {
+		if recommendation.Value <= 0 {
+			continue
+		}
+
+		thresholds = append(thresholds, backtest_threshold{
+			name:      recommendation.Threshold,
+			metric:    recommendation.Reasoning.Metric,
+			direction: recommendation.Reasoning.Direction,
+			value:     uint(recommendation.Value),
+		})
+	}
+
+	return thresholds, nil
+}
+
+// Generates SQL query which finds hosts, minutes and events when traffic exceeded threshold
+// Minutes which are closer than event_gap_minutes to each other belong to same event
+// By default we replay thresholds over all traffic because attacks are exactly what thresholds must catch
+func generate_backtest_query(host_group Ban_settings_t, threshold backtest_threshold, event_gap_minutes int64, window calculation_window, apply_exclusions bool) built_query {
+	source := generate_metrics_source_with_exclusions(host_group, window, apply_exclusions)
+
+	host_expression := "host"
+
+	// Every sample of total hostgroup describes whole hostgroup
+	if host_group.Calculation_method == "total" {
+		host_expression = "'total'"
+	}
+
+	threshold_value := uint64(threshold.value)
+
+	// Thresholds use megabits but we keep bits
+	if threshold_unit(threshold.metric) == "mbps" {
+		threshold_value = threshold_value * 1000000
+	}
+
+	column := threshold.metric + "_" + threshold.direction
+
+	exceeded_minutes := new_select_query(host_expression+" AS exceeded_host", fmt.Sprintf("arraySort(%s) AS minutes", aggregate_function_call("groupUniqArray", "", nil, "toUInt32(toStartOfMinute(metricDateTime))"))).
+		from(source.table).where(source.where_clause, query_text(fmt.Sprintf("%s > %d", quote_clickhouse_identifier(column), threshold_value))).group("exceeded_host")
+
+	return new_select_query("COUNT(*)", aggregate_function_call("sum", "", nil, "length(minutes)"),
+		aggregate_function_call("sum", "", nil, fmt.Sprintf("length(arrayFilter((minute, index) -> index = 1 OR minute - minutes[index - 1] > %d, minutes, arrayEnumerate(minutes)))", event_gap_minutes*60))).
+		from_subquery(exceeded_minutes).build()
+}
+
+// Replays threshold over traffic of hostgroup in calculation window
+func backtest_threshold_for_hostgroup(ctx context.Context, host_group Ban_settings_t, clickhouse_client *sql.DB, threshold backtest_threshold, event_gap_minutes int64, window calculation_window, apply_exclusions bool) (*BacktestResult, error) {
+	query := generate_backtest_query(host_group, threshold, event_gap_minutes, window, apply_exclusions)
+
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("SQL Query: %s\n", query.sql)
+	}
+
+	result := &BacktestResult{
+		Hostgroup: host_group.Name,
+		Threshold: threshold.name,
+		Value:     threshold.value,
+		Unit:      threshold_unit(threshold.metric),
+		Metric:    threshold.metric,
+		Direction: threshold.direction,
+	}
+
+	query_ctx, cancel := with_query_timeout(ctx)
+	defer cancel()
+
+	err := clickhouse_client.QueryRowContext(query_ctx, query.sql, query.arguments()...).Scan(&result.Hosts, &result.Minutes, &result.Events)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w", query.sql, err)
+	}
+
+	return result, nil
+}
+
+// Prints results of backtest in table or json format
+func print_backtest_results(output io.Writer, format string, results []*BacktestResult) error {
+	if format == "json" {
+		json_output, err := json.MarshalIndent(results, "", "  ")
+
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(output, string(json_output))
+
+		return err
+	}
+
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(table, "Hostgroup\tThreshold\tValue\tHosts\tMinutes\tEvents\n")
+
+	for _, result := range results {
+		fmt.Fprintf(table, "%s\t%s\t%d %s\t%d\t%d\t%d\n", result.Hostgroup, result.Threshold, result.Value, result.Unit, result.Hosts, result.Minutes, result.Events)
+	}
+
+	return table.Flush()
+}
+
+// Replays current or recommended thresholds over traffic from calculation window
+func backtest_command(arguments []string) int {
+	flag_set := new_command_flag_set("backtest", "[hostgroup]")
+	thresholds_source := flag_set.String("thresholds", "current", "Thresholds which we replay: current from hostgroups configuration or recommended")
+	format := flag_set.String("format", "table", "Output format: table or json")
+	event_gap_minutes := flag_set.Int64("event-gap", 1, "Minutes of exceeding separated by more than this number of minutes are different events")
+	apply_exclusions := flag_set.Bool("apply-exclusions", false, "Remove attack periods and maintenance windows from traffic like baseline calculation does")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() > 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	if *thresholds_source != "current" && *thresholds_source != "recommended" {
+		fmt.Fprintf(os.Stderr, "Unknown thresholds %s, we support current and recommended\n", *thresholds_source)
+		return 2
+	}
+
+	if *format != "table" && *format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, we support table and json\n", *format)
+		return 2
+	}
+
+	if *event_gap_minutes < 1 {
+		fmt.Fprintf(os.Stderr, "--event-gap must be positive\n")
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	clickhouse_client, err := connect_to_clickhouse(ctx)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	defer clickhouse_client.Close()
+
+	host_groups, err := read_hostgroups(ctx, new_mongodb_storage(mongo_client), nil)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	window := new_calculation_window(time.Now())
+
+	if *apply_exclusions {
+		err = load_attack_exclusions(ctx, mongo_client, window)
+
+		if err != nil {
+			fast_logger.Print(err)
+			return 1
+		}
+	}
+
+	results := []*BacktestResult{}
+	found_hostgroup := false
+
+	for _, host_group := range host_groups {
+		if flag_set.NArg() == 1 && host_group.Name != flag_set.Arg(0) {
+			continue
+		}
+
+		found_hostgroup = true
+
+		thresholds := current_backtest_thresholds(host_group)
+
+		if *thresholds_source == "recommended" {
+			thresholds, err = recommended_backtest_thresholds(ctx, mongo_client, host_group)
+
+			if err != nil {
+				fast_logger.Printf("Cannot read recommended thresholds for %s: %v", host_group.Name, err)
+				continue
+			}
+		}
+
+		for _, threshold := range thresholds {
+			result, err := backtest_threshold_for_hostgroup(ctx, host_group, clickhouse_client, threshold, *event_gap_minutes, window, *apply_exclusions)
+
+			if err != nil {
+				fast_logger.Printf("Cannot backtest %s for %s: %v", threshold.name, host_group.Name, err)
+				continue
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	if !found_hostgroup {
+		fast_logger.Printf("We have no hostgroup %s", flag_set.Arg(0))
+		return 1
+	}
+
+	err = print_backtest_results(os.Stdout, *format, results)
+
+	if err != nil {
+		fast_logger.Printf("Cannot print report: %v", err)
+		return 1
+	}
+
+	return 0
+}
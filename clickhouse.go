@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// Name of TLS configuration which we register in Clickhouse driver
+const clickhouse_tls_config_name = "baseline_exporter"
+
+// Options of Clickhouse driver which we set ourselves, they cannot be used as query settings
+var clickhouse_reserved_options = []string{"username", "password", "database", "secure", "skip_verify", "tls_config", "compress", "alt_hosts", "connection_open_strategy"}
+
+// Replaces Clickhouse connection details from FastNetMon by values from our configuration when they're set
+func apply_clickhouse_configuration() {
+	if configuration.ClickhouseHost != "" {
+		current_global_conf.Clickhouse_metrics_host = configuration.ClickhouseHost
+	}
+
+	if configuration.ClickhousePort != 0 {
+		current_global_conf.Clickhouse_metrics_port = configuration.ClickhousePort
+	}
+
+	if configuration.ClickhouseUsername != "" {
+		current_global_conf.Clickhouse_metrics_username = configuration.ClickhouseUsername
+	}
+
+	if configuration.ClickhousePassword != "" {
+		current_global_conf.Clickhouse_metrics_password = configuration.ClickhousePassword
+	}
+
+	if configuration.ClickhouseDatabase != "" {
+		current_global_conf.Clickhouse_metrics_database = configuration.ClickhouseDatabase
+	}
+}
+
+// Checks Clickhouse options from configuration
+func validate_clickhouse_configuration() error {
+	for name := range configuration.ClickhouseSettings {
+		for _, reserved_option := range clickhouse_reserved_options {
+			if name == reserved_option {
+				return fmt.Errorf("clickhouse_settings cannot have %s, use separate option for it", name)
+			}
+		}
+	}
+
+	for _, host := range configuration.ClickhouseAltHosts {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			return fmt.Errorf("clickhouse_alt_hosts must have host:port format, we have %s", host)
+		}
+	}
+
+	if configuration.ClickhouseTLSKeyFile != "" && configuration.ClickhouseTLSCertFile == "" {
+		return fmt.Errorf("clickhouse_tls_key_file requires clickhouse_tls_cert_file")
+	}
+
+	return nil
+}
+
+// Creates TLS configuration for Clickhouse connection from CA and client certificate files
+func clickhouse_tls_config() (*tls.Config, error) {
+	tls_config := &tls.Config{InsecureSkipVerify: configuration.ClickhouseTLSInsecure}
+
+	if configuration.ClickhouseTLSCAFile != "" {
+		ca_certificate, err := ioutil.ReadFile(configuration.ClickhouseTLSCAFile)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read Clickhouse CA file %s: %w", configuration.ClickhouseTLSCAFile, err)
+		}
+
+		tls_config.RootCAs = x509.NewCertPool()
+
+		if !tls_config.RootCAs.AppendCertsFromPEM(ca_certificate) {
+			return nil, fmt.Errorf("Clickhouse CA file %s has no PEM certificates", configuration.ClickhouseTLSCAFile)
+		}
+	}
+
+	if configuration.ClickhouseTLSCertFile != "" {
+		// Key can be stored in same file with certificate
+		key_file := configuration.ClickhouseTLSKeyFile
+
+		if key_file == "" {
+			key_file = configuration.ClickhouseTLSCertFile
+		}
+
+		certificate, err := tls.LoadX509KeyPair(configuration.ClickhouseTLSCertFile, key_file)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load Clickhouse client certificate %s: %w", configuration.ClickhouseTLSCertFile, err)
+		}
+
+		tls_config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tls_config, nil
+}
+
+// Generates DSN for Clickhouse driver
+// We register TLS configuration in driver when TLS is enabled
+func generate_clickhouse_dsn() (string, error) {
+	if err := validate_clickhouse_configuration(); err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+
+	// Query settings go first and cannot override our options because we checked names
+	for name, value := range configuration.ClickhouseSettings {
+		query.Set(name, value)
+	}
+
+	if current_global_conf.Clickhouse_metrics_username != "" {
+		query.Set("username", current_global_conf.Clickhouse_metrics_username)
+	}
+
+	if current_global_conf.Clickhouse_metrics_password != "" {
+		query.Set("password", current_global_conf.Clickhouse_metrics_password)
+	}
+
+	if current_global_conf.Clickhouse_metrics_database != "" {
+		query.Set("database", current_global_conf.Clickhouse_metrics_database)
+	}
+
+	if configuration.ClickhouseTLS || configuration.ClickhouseTLSCAFile != "" || configuration.ClickhouseTLSCertFile != "" {
+		tls_config, err := clickhouse_tls_config()
+
+		if err != nil {
+			return "", err
+		}
+
+		err = clickhouse.RegisterTLSConfig(clickhouse_tls_config_name, tls_config)
+
+		if err != nil {
+			return "", fmt.Errorf("Cannot register TLS configuration for Clickhouse: %w", err)
+		}
+
+		query.Set("tls_config", clickhouse_tls_config_name)
+	}
+
+	if configuration.ClickhouseCompress {
+		query.Set("compress", "true")
+	}
+
+	if len(configuration.ClickhouseAltHosts) > 0 {
+		query.Set("alt_hosts", strings.Join(configuration.ClickhouseAltHosts, ","))
+
+		// We try main host first and use alternative hosts only when it fails
+		query.Set("connection_open_strategy", "in_order")
+	}
+
+	dsn := url.URL{
+		Scheme:   "tcp",
+		Host:     net.JoinHostPort(current_global_conf.Clickhouse_metrics_host, strconv.FormatUint(uint64(current_global_conf.Clickhouse_metrics_port), 10)),
+		RawQuery: query.Encode(),
+	}
+
+	return dsn.String(), nil
+}
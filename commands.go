@@ -0,0 +1,836 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Command line command with handler which returns exit code
+type cli_command struct {
+	name        string
+	arguments   string
+	description string
+	handler     func(arguments []string) int
+}
+
+var cli_commands = []cli_command{
+	{"run", "[--daemon] [--dry-run]", "Generate baselines and top talkers for all hostgroups and store them in MongoDB (default)", run_command},
+	{"show-baseline", "<hostgroup>", "Print baseline stored in MongoDB for hostgroup", show_baseline_command},
+	{"show-top-talkers", "<hostgroup>", "Print top talkers stored in MongoDB for hostgroup", show_top_talkers_command},
+	{"show-seasonal-baseline", "<hostgroup>", "Print seasonal baseline for hostgroup or its bucket for specific time", show_seasonal_baseline_command},
+	{"show-host-baseline", "<ip>", "Print baselines stored in MongoDB for host", show_host_baseline_command},
+	{"show-recommendations", "<hostgroup>", "Print recommended thresholds stored in MongoDB for hostgroup", show_recommendations_command},
+	{"show-history", "<hostgroup>", "Print history of baselines for hostgroup", show_history_command},
+	{"apply", "[hostgroup]", "Copy recommended thresholds into hostgroups configuration after approval", apply_command},
+	{"rollback", "<run-id>", "Restore thresholds changed by apply run", rollback_command},
+	{"audit-thresholds", "[hostgroup]", "Report thresholds which are lower than normal traffic or too close to it", audit_thresholds_command},
+	{"backtest", "[hostgroup]", "Replay current or recommended thresholds over traffic from calculation period", backtest_command},
+	{"show-overlaps", "", "Print networks from different hostgroups which cover same hosts", show_overlaps_command},
+	{"show-run-report", "", "Print report about latest export run", show_run_report_command},
+	{"explain", "[hostgroup]", "Print SQL queries which we use to generate baselines and top talkers", explain_command},
+	{"validate-config", "", "Check configuration files and exit", validate_config_command},
+}
+
+// Returns command by name or nil when we do not have such command
+func find_cli_command(name string) *cli_command {
+	for index := range cli_commands {
+		if cli_commands[index].name == name {
+			return &cli_commands[index]
+		}
+	}
+
+	return nil
+}
+
+// Prints list of commands and global flags
+func print_usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [global flags] <command> [command flags] [arguments]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+
+	for _, command := range cli_commands {
+		fmt.Fprintf(os.Stderr, "  %-18s %-12s %s\n", command.name, command.arguments, command.description)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+}
+
+// Creates flag set for command with usage which mentions command arguments
+func new_command_flag_set(command_name string, command_arguments string) *flag.FlagSet {
+	flag_set := flag.NewFlagSet(command_name, flag.ExitOnError)
+
+	flag_set.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [global flags] %s [command flags] %s\n", os.Args[0], command_name, command_arguments)
+		flag_set.PrintDefaults()
+	}
+
+	return flag_set
+}
+
+// Returns context for command which is cancelled on first SIGINT or SIGTERM
+// We restore default handling of signals after that and next signal terminates us immediately
+func command_context() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case received_signal := <-signals:
+			fast_logger.Printf("Received %v, cancelling command", received_signal)
+			cancel()
+		case <-ctx.Done():
+		}
+
+		signal.Stop(signals)
+	}()
+
+	return ctx, cancel
+}
+
+// Loads configuration, connects to MongoDB and reads FastNetMon configuration
+// It's common prefix for all commands which talk to databases
+func prepare_mongodb_connection(ctx context.Context) *mongo.Client {
+	err := load_baseline_exporter_configuration()
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	err = load_database_configuration()
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	mongo_client, err := connect_to_mongodb(ctx)
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	err = read_fastnetmon_configuration(ctx, new_mongodb_storage(mongo_client))
+
+	if err != nil {
+		disconnect_from_mongodb(mongo_client)
+		fast_logger.Fatal(err)
+	}
+
+	return mongo_client
+}
+
+// Loads configuration, connects to storage backend and reads FastNetMon configuration
+// It's common prefix for commands which work with any storage backend
+func prepare_storage(ctx context.Context) storage_backend {
+	err := load_baseline_exporter_configuration()
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	err = load_database_configuration()
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	storage, err := connect_to_storage(ctx)
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	err = read_fastnetmon_configuration(ctx, storage)
+
+	if err != nil {
+		storage.close()
+		fast_logger.Fatal(err)
+	}
+
+	return storage
+}
+
+// Generates baselines and top talkers once or in daemon mode
+func run_command(arguments []string) int {
+	flag_set := new_command_flag_set("run", "")
+	daemon_mode := flag_set.Bool("daemon", false, "Run as long-running daemon and recompute baselines according to schedule from configuration")
+	dry_run_mode := flag_set.Bool("dry-run", false, "Print computed results and difference with MongoDB to stdout instead of writing them")
+	dry_run_format := flag_set.String("format", "json", "Output format for dry run: json or table")
+	flag_set.Parse(arguments)
+
+	if *daemon_mode && *dry_run_mode {
+		fmt.Fprintf(os.Stderr, "--dry-run cannot be used in daemon mode\n")
+		return 2
+	}
+
+	if *dry_run_format != "json" && *dry_run_format != "table" {
+		fmt.Fprintf(os.Stderr, "Unknown format %s, we support json and table\n", *dry_run_format)
+		return 2
+	}
+
+	ensure_root_rights()
+
+	// Keep stdout clean for results of dry run
+	console := os.Stdout
+
+	if *dry_run_mode {
+		console = os.Stderr
+	}
+
+	log_file := setup_logging(console)
+	defer log_file.Close()
+
+	fast_logger.Printf("Started Baseline exporter %s", exporter_version)
+
+	err := load_baseline_exporter_configuration()
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	var schedule *cron_schedule
+
+	if *daemon_mode {
+		if configuration.DaemonSchedule != "" {
+			schedule, err = parse_cron_schedule(configuration.DaemonSchedule)
+
+			if err != nil {
+				fast_logger.Fatalf("Cannot parse daemon_schedule '%s': %v", configuration.DaemonSchedule, err)
+			}
+		} else if configuration.DaemonInterval <= 0 {
+			fast_logger.Fatalf("daemon_interval must be positive number of seconds, we have %d", configuration.DaemonInterval)
+		}
+	}
+
+	err = load_database_configuration()
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	// First signal asks us to stop after in-flight hostgroups, second one cancels it
+	stop_ctx, stop := context.WithCancel(context.Background())
+	query_ctx, cancel_queries := context.WithCancel(context.Background())
+
+	defer stop()
+	defer cancel_queries()
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		received_signal := <-signals
+		fast_logger.Printf("Received %v, we will stop after processing of in-flight hostgroups", received_signal)
+		stop()
+
+		received_signal = <-signals
+		fast_logger.Printf("Received %v again, cancelling in-flight hostgroups", received_signal)
+		cancel_queries()
+	}()
+
+	storage, err := connect_to_storage(query_ctx)
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	defer storage.close()
+
+	err = read_fastnetmon_configuration(query_ctx, storage)
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	clickhouse_client, err := connect_to_clickhouse(query_ctx)
+
+	if err != nil {
+		fast_logger.Fatal(err)
+	}
+
+	defer clickhouse_client.Close()
+
+	if !*daemon_mode {
+		var dry_run *dry_run_report
+
+		if *dry_run_mode {
+			dry_run = &dry_run_report{}
+		}
+
+		report, err := run_export_cycle(stop_ctx, query_ctx, storage, clickhouse_client, dry_run)
+
+		if err != nil {
+			fast_logger.Printf("Baseline export stopped: %v", err)
+		}
+
+		if dry_run != nil && err == nil {
+			if exit_code := dry_run.print(os.Stdout, *dry_run_format); exit_code != 0 {
+				return exit_code
+			}
+		}
+
+		return report.exit_code()
+	}
+
+	run_daemon(stop_ctx, query_ctx, schedule, storage, clickhouse_client)
+
+	fast_logger.Printf("Baseline exporter daemon stopped")
+
+	return 0
+}
+
+// Prints document with specified name from storage collection as JSON
+func show_document_by_name(command_name string, arguments []string, collection_name string, document interface{}) int {
+	flag_set := new_command_flag_set(command_name, "<hostgroup>")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() != 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	hostgroup_name := flag_set.Arg(0)
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	storage := prepare_storage(ctx)
+	defer storage.close()
+
+	found, err := storage.read_document(ctx, collection_name, hostgroup_name, document)
+
+	if err != nil {
+		fast_logger.Printf("Cannot read %s for hostgroup %s: %v", collection_name, hostgroup_name, err)
+		return 1
+	}
+
+	if !found {
+		fast_logger.Printf("We have no data for hostgroup %s in %s", hostgroup_name, collection_name)
+		return 1
+	}
+
+	return print_json(document)
+}
+
+// Reads document with specified name from MongoDB collection
+func read_document_by_name(ctx context.Context, mongo_client *mongo.Client, collection_name string, name string, document interface{}) (bool, error) {
+	collection := mongo_client.Database(global_db_conf.Db_name).Collection(collection_name)
+
+	err := collection.FindOne(ctx, bson.D{{Key: "name", Value: name}}).Decode(document)
+
+	if err == mongo.ErrNoDocuments {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Replaces document with specified name in MongoDB collection or inserts it when we do not have it
+func replace_document_by_name(ctx context.Context, mongo_client *mongo.Client, collection_name string, name string, document interface{}) error {
+	collection := mongo_client.Database(global_db_conf.Db_name).Collection(collection_name)
+
+	filter := bson.D{{Key: "name", Value: name}}
+
+	true_bool := new(bool)
+	*true_bool = true
+
+	_, err := collection.ReplaceOne(ctx, filter, document, &options.ReplaceOptions{Upsert: true_bool})
+
+	return err
+}
+
+// Prints indented JSON to stdout
+func print_json(document interface{}) int {
+	json_output, err := json.MarshalIndent(document, "", "  ")
+
+	if err != nil {
+		fast_logger.Printf("Cannot encode JSON: %v", err)
+		return 1
+	}
+
+	fmt.Println(string(json_output))
+
+	return 0
+}
+
+// Prints baseline for hostgroup from MongoDB
+func show_baseline_command(arguments []string) int {
+	return show_document_by_name("show-baseline", arguments, hostgroups_baseline_collection_name, &BaselineStructure{})
+}
+
+// Prints top talkers for hostgroup from MongoDB
+func show_top_talkers_command(arguments []string) int {
+	return show_document_by_name("show-top-talkers", arguments, hostgroups_top_talkers_collection_name, &TopTalkersStructure{})
+}
+
+// Prints recommended thresholds for hostgroup from MongoDB
+func show_recommendations_command(arguments []string) int {
+	return show_document_by_name("show-recommendations", arguments, hostgroups_recommendations_collection_name, &RecommendationsStructure{})
+}
+
+// Prints seasonal baseline for hostgroup, with --at it prints only bucket which covers that time
+func show_seasonal_baseline_command(arguments []string) int {
+	flag_set := new_command_flag_set("show-seasonal-baseline", "<hostgroup>")
+	at_argument := flag_set.String("at", "", "Print only bucket for this time: RFC3339 time or now")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() != 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	hostgroup_name := flag_set.Arg(0)
+
+	at := time.Now()
+
+	if *at_argument != "" && *at_argument != "now" {
+		parsed_time, err := time.Parse(time.RFC3339, *at_argument)
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad --at: %v\n", err)
+			return 2
+		}
+
+		at = parsed_time
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	storage := prepare_storage(ctx)
+	defer storage.close()
+
+	seasonal_baseline := &SeasonalBaselineStructure{}
+
+	found, err := storage.read_document(ctx, hostgroups_seasonal_baseline_collection_name, hostgroup_name, seasonal_baseline)
+
+	if err != nil {
+		fast_logger.Printf("Cannot read seasonal baseline for hostgroup %s: %v", hostgroup_name, err)
+		return 1
+	}
+
+	if !found {
+		fast_logger.Printf("We have no seasonal baseline for hostgroup %s", hostgroup_name)
+		return 1
+	}
+
+	if *at_argument == "" {
+		return print_json(seasonal_baseline)
+	}
+
+	bucket, err := seasonal_baseline.bucket_for(at)
+
+	if err != nil {
+		fast_logger.Printf("Cannot find bucket: %v", err)
+		return 1
+	}
+
+	if bucket == nil {
+		fast_logger.Printf("We have no data for %s in seasonal baseline for hostgroup %s", at.Format(time.RFC3339), hostgroup_name)
+		return 1
+	}
+
+	return print_json(bucket)
+}
+
+// Prints baselines for host from all hostgroups
+func show_host_baseline_command(arguments []string) int {
+	flag_set := new_command_flag_set("show-host-baseline", "<ip>")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() != 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	host_baselines, err := read_host_baselines(ctx, mongo_client, flag_set.Arg(0))
+
+	if err != nil {
+		fast_logger.Printf("Cannot read baselines for host %s: %v", flag_set.Arg(0), err)
+		return 1
+	}
+
+	if len(host_baselines) == 0 {
+		fast_logger.Printf("We have no baselines for host %s", flag_set.Arg(0))
+		return 1
+	}
+
+	return print_json(host_baselines)
+}
+
+// Prints history of baselines for hostgroup
+func show_history_command(arguments []string) int {
+	flag_set := new_command_flag_set("show-history", "<hostgroup>")
+	since_argument := flag_set.String("since", "", "Show snapshots computed after this time, RFC3339 time or duration before now like 720h")
+	until_argument := flag_set.String("until", "", "Show snapshots computed before this time, RFC3339 time or duration before now")
+	limit := flag_set.Int64("limit", 0, "Maximum number of snapshots, newest first")
+	field := flag_set.String("field", "", "Print only this field as table, e.g. incoming.bits.quantile_95")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() != 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	since, err := parse_time_or_duration(*since_argument)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad --since: %v\n", err)
+		return 2
+	}
+
+	until, err := parse_time_or_duration(*until_argument)
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad --until: %v\n", err)
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	history, err := read_baseline_history(ctx, mongo_client, flag_set.Arg(0), since, until, *limit)
+
+	if err != nil {
+		fast_logger.Printf("Cannot read history for hostgroup %s: %v", flag_set.Arg(0), err)
+		return 1
+	}
+
+	if *field == "" {
+		return print_json(history)
+	}
+
+	for _, entry := range history {
+		flat_baseline, err := flatten_document(entry.BaselineStructure)
+
+		if err != nil {
+			fast_logger.Printf("Cannot process baseline: %v", err)
+			return 1
+		}
+
+		fmt.Printf("%s\t%s\n", entry.ComputedAt.Format(time.RFC3339), format_document_value(flat_baseline[*field]))
+	}
+
+	return 0
+}
+
+// Prints SQL queries for all hostgroups or for specified one
+func explain_command(arguments []string) int {
+	flag_set := new_command_flag_set("explain", "[hostgroup]")
+	flag_set.Parse(arguments)
+
+	if flag_set.NArg() > 1 {
+		flag_set.Usage()
+		return 2
+	}
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	storage := prepare_storage(ctx)
+	defer storage.close()
+
+	host_groups, err := read_hostgroups(ctx, storage, nil)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	window := new_calculation_window(time.Now())
+
+	statistics, err := configured_statistics()
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	err = load_attack_exclusions(ctx, storage.mongodb_client(), window)
+
+	if err != nil {
+		fast_logger.Print(err)
+		return 1
+	}
+
+	found_hostgroup := false
+
+	for _, host_group := range host_groups {
+		if flag_set.NArg() == 1 && host_group.Name != flag_set.Arg(0) {
+			continue
+		}
+
+		found_hostgroup = true
+
+		fmt.Printf("-- Hostgroup %s\n", host_group.Name)
+
+		// Outlier bounds depend on data and we show baseline queries without them
+		if configuration.OutlierRejection != "" {
+			fmt.Printf("-- Outlier medians, queries below are shown without outlier bounds\n%s;\n\n", generate_outlier_medians_query(host_group, window).inlined())
+		}
+
+		fmt.Printf("-- Baseline\n%s;\n\n", generate_baseline_query(host_group, statistics, window, nil).inlined())
+
+		if configuration.SeasonalBaseline {
+			fmt.Printf("-- Seasonal baseline\n%s;\n\n", generate_seasonal_baseline_query(host_group, statistics, window, nil).inlined())
+		}
+
+		if configuration.PerHostBaseline {
+			fmt.Printf("-- Host baselines\n%s;\n\n", generate_host_baselines_query(host_group, statistics, window).inlined())
+		}
+
+		// Top talkers are per host and we calculate them only for per_host hostgroups
+		if host_group.Calculation_method == "total" {
+			continue
+		}
+
+		fmt.Printf("-- Top talkers\n%s;\n\n", generate_top_talkers_query(host_group.Name, host_group.Networks, configuration.NumberOfTopTalkers, window, traffic_metric_columns).inlined())
+	}
+
+	if !found_hostgroup {
+		fast_logger.Printf("We have no hostgroup %s", flag_set.Arg(0))
+		return 1
+	}
+
+	return 0
+}
+
+// Checks configuration files and reports all problems we found
+func validate_config_command(arguments []string) int {
+	flag_set := new_command_flag_set("validate-config", "")
+	flag_set.Parse(arguments)
+
+	// We do not need log file here and we want to run without root rights
+	fast_logger.SetOutput(os.Stderr)
+
+	problems := []string{}
+
+	err := load_baseline_exporter_configuration()
+
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		problems = append(problems, validate_baseline_exporter_configuration()...)
+	}
+
+	err = load_database_configuration()
+
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		problems = append(problems, validate_storage_configuration()...)
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Printf("Problem: %s\n", problem)
+		}
+
+		return 1
+	}
+
+	fmt.Println("Configuration is valid")
+
+	return 0
+}
+
+// Checks configuration of storage backend
+func validate_storage_configuration() []string {
+	problems := []string{}
+
+	switch storage_backend_name() {
+	case "", "mongodb":
+		if _, err := mongodb_client_options(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	case "file":
+		if configuration.StorageDirectory == "" {
+			problems = append(problems, "storage_directory is required for file storage backend")
+		} else if _, err := new_file_storage(configuration.StorageDirectory); err != nil {
+			problems = append(problems, err.Error())
+		}
+
+		if configuration.ExclusionsCollection != "" {
+			problems = append(problems, "exclusions_collection requires mongodb storage backend")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("Unsupported storage backend %s, we support mongodb and file", storage_backend_name()))
+	}
+
+	return problems
+}
+
+// Checks values of baseline exporter configuration
+func validate_baseline_exporter_configuration() []string {
+	problems := []string{}
+
+	// Catch misspelled options which we silently ignore during normal load
+	if is_file_exists(baseline_exporter_configuration_path) {
+		file_as_array, err := ioutil.ReadFile(baseline_exporter_configuration_path)
+
+		if err != nil {
+			return append(problems, err.Error())
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(file_as_array))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(&BaselineExporterConfiguration{}); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", baseline_exporter_configuration_path, err))
+		}
+	}
+
+	if configuration.CalculationPeriod <= 0 {
+		problems = append(problems, fmt.Sprintf("calculaton_period must be positive, we have %d", configuration.CalculationPeriod))
+	}
+
+	if statistics, err := configured_statistics(); err != nil {
+		problems = append(problems, err.Error())
+	} else if configuration.ThresholdRecommendations {
+		problems = append(problems, validate_threshold_rules(statistics)...)
+	}
+
+	if configuration.NumberOfTopTalkers == 0 {
+		problems = append(problems, "number_of_top_talkers must be positive")
+	}
+
+	if configuration.LogLevel != "info" && configuration.LogLevel != "debug" {
+		problems = append(problems, fmt.Sprintf("log_level must be info or debug, we have %s", configuration.LogLevel))
+	}
+
+	if configuration.DaemonInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("daemon_interval must be positive, we have %d", configuration.DaemonInterval))
+	}
+
+	if err := validate_seasonal_configuration(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if err := validate_outlier_configuration(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if err := validate_clickhouse_configuration(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if configuration.ExclusionsFile != "" {
+		exclusions, err := read_attack_exclusions_file(configuration.ExclusionsFile)
+
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+
+		for _, exclusion := range exclusions {
+			if err := validate_attack_exclusion(exclusion); err != nil {
+				problems = append(problems, fmt.Sprintf("%s: %v", configuration.ExclusionsFile, err))
+			}
+		}
+	}
+
+	if configuration.HostgroupMetricsTable != "" {
+		if err := validate_clickhouse_identifier("hostgroup_metrics_table", configuration.HostgroupMetricsTable); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if configuration.ThresholdAuditHeadroom < 0 {
+		problems = append(problems, fmt.Sprintf("threshold_audit_headroom must not be negative, we have %g", configuration.ThresholdAuditHeadroom))
+	}
+
+	if configuration.Workers < 1 {
+		problems = append(problems, fmt.Sprintf("workers must be positive, we have %d", configuration.Workers))
+	}
+
+	if configuration.QueryTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("query_timeout must not be negative, we have %d", configuration.QueryTimeout))
+	}
+
+	if configuration.HostgroupTimeout < 0 {
+		problems = append(problems, fmt.Sprintf("hostgroup_timeout must not be negative, we have %d", configuration.HostgroupTimeout))
+	}
+
+	if configuration.Retries < 0 {
+		problems = append(problems, fmt.Sprintf("retries must not be negative, we have %d", configuration.Retries))
+	}
+
+	if configuration.RetryDelay <= 0 {
+		problems = append(problems, fmt.Sprintf("retry_delay must be positive, we have %d", configuration.RetryDelay))
+	}
+
+	if configuration.NetworkTableThreshold < 1 {
+		problems = append(problems, fmt.Sprintf("network_table_threshold must be positive, we have %d", configuration.NetworkTableThreshold))
+	}
+
+	if configuration.RetryMaxDelay < configuration.RetryDelay {
+		problems = append(problems, fmt.Sprintf("retry_max_delay must not be lower than retry_delay, we have %d", configuration.RetryMaxDelay))
+	}
+
+	if configuration.PerHostBaselineMaxHosts == 0 {
+		problems = append(problems, "per_host_baseline_max_hosts must be positive")
+	}
+
+	if configuration.HistoryRetention < 0 || configuration.HistoryRetention > math.MaxInt32 {
+		problems = append(problems, fmt.Sprintf("history_retention must be between 0 and %d, we have %d", math.MaxInt32, configuration.HistoryRetention))
+	}
+
+	if configuration.DaemonSchedule != "" {
+		if _, err := parse_cron_schedule(configuration.DaemonSchedule); err != nil {
+			problems = append(problems, fmt.Sprintf("daemon_schedule '%s' is invalid: %v", configuration.DaemonSchedule, err))
+		}
+	}
+
+	return problems
+}
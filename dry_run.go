@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+)
+
+// Single difference between document stored in storage and computed one
+type document_change struct {
+	Path     string      `json:"path"`
+	Stored   interface{} `json:"stored"`
+	Computed interface{} `json:"computed"`
+}
+
+// Results of dry run for single hostgroup
+type dry_run_result struct {
+	Name string `json:"name"`
+
+	Baseline        *BaselineStructure `json:"baseline,omitempty"`
+	BaselineStored  bool               `json:"baseline_stored"`
+	BaselineChanges []document_change  `json:"baseline_changes"`
+
+	SeasonalBaseline        *SeasonalBaselineStructure `json:"seasonal_baseline,omitempty"`
+	SeasonalBaselineStored  bool                       `json:"seasonal_baseline_stored"`
+	SeasonalBaselineChanges []document_change          `json:"seasonal_baseline_changes"`
+
+	HostBaselines []*HostBaselineStructure `json:"host_baselines,omitempty"`
+
+	Recommendations        *RecommendationsStructure `json:"recommendations,omitempty"`
+	RecommendationsStored  bool                      `json:"recommendations_stored"`
+	RecommendationsChanges []document_change         `json:"recommendations_changes"`
+
+	TopTalkers        *TopTalkersStructure `json:"top_talkers,omitempty"`
+	TopTalkersStored  bool                 `json:"top_talkers_stored"`
+	TopTalkersChanges []document_change    `json:"top_talkers_changes"`
+}
+
+// Collects computed results for all hostgroups during dry run
+// Every result is changed only by worker which processes its hostgroup, mutex protects list of results
+type dry_run_report struct {
+	mutex   sync.Mutex
+	results []*dry_run_result
+}
+
+// Returns result for hostgroup and creates it when we do not have it yet
+func (report *dry_run_report) result_for(hostgroup_name string) *dry_run_result {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	for _, result := range report.results {
+		if result.Name == hostgroup_name {
+			return result
+		}
+	}
+
+	result := &dry_run_result{Name: hostgroup_name}
+	report.results = append(report.results, result)
+
+	return result
+}
+
+// Adds computed baseline and compares it with baseline from storage
+func (report *dry_run_report) add_baseline(ctx context.Context, storage storage_backend, baseline *BaselineStructure) error {
+	result := report.result_for(baseline.Name)
+	result.Baseline = baseline
+
+	stored_baseline := &BaselineStructure{}
+
+	found, err := storage.read_document(ctx, hostgroups_baseline_collection_name, baseline.Name, stored_baseline)
+
+	if err != nil {
+		return err
+	}
+
+	result.BaselineStored = found
+
+	if !found {
+		stored_baseline = nil
+	}
+
+	result.BaselineChanges, err = compare_documents(stored_baseline, baseline)
+
+	return err
+}
+
+// Adds computed seasonal baseline and compares it with seasonal baseline from storage
+func (report *dry_run_report) add_seasonal_baseline(ctx context.Context, storage storage_backend, seasonal_baseline *SeasonalBaselineStructure) error {
+	result := report.result_for(seasonal_baseline.Name)
+	result.SeasonalBaseline = seasonal_baseline
+
+	stored_seasonal_baseline := &SeasonalBaselineStructure{}
+
+	found, err := storage.read_document(ctx, hostgroups_seasonal_baseline_collection_name, seasonal_baseline.Name, stored_seasonal_baseline)
+
+	if err != nil {
+		return err
+	}
+
+	result.SeasonalBaselineStored = found
+
+	if !found {
+		stored_seasonal_baseline = nil
+	}
+
+	result.SeasonalBaselineChanges, err = compare_documents(stored_seasonal_baseline, seasonal_baseline)
+
+	return err
+}
+
+// Adds computed baselines of hosts, we do not compare them because there can be too many of them
+func (report *dry_run_report) add_host_baselines(hostgroup_name string, host_baselines []*HostBaselineStructure) {
+	report.result_for(hostgroup_name).HostBaselines = host_baselines
+}
+
+// Adds computed threshold recommendations and compares them with recommendations from storage
+func (report *dry_run_report) add_recommendations(ctx context.Context, storage storage_backend, recommendations *RecommendationsStructure) error {
+	result := report.result_for(recommendations.Name)
+	result.Recommendations = recommendations
+
+	stored_recommendations := &RecommendationsStructure{}
+
+	found, err := storage.read_document(ctx, hostgroups_recommendations_collection_name, recommendations.Name, stored_recommendations)
+
+	if err != nil {
+		return err
+	}
+
+	result.RecommendationsStored = found
+
+	if !found {
+		stored_recommendations = nil
+	}
+
+	result.RecommendationsChanges, err = compare_documents(stored_recommendations, recommendations)
+
+	return err
+}
+
+// Adds computed top talkers and compares them with top talkers from storage
+func (report *dry_run_report) add_top_talkers(ctx context.Context, storage storage_backend, top_talkers *TopTalkersStructure) error {
+	result := report.result_for(top_talkers.Name)
+	result.TopTalkers = top_talkers
+
+	stored_top_talkers := &TopTalkersStructure{}
+
+	found, err := storage.read_document(ctx, hostgroups_top_talkers_collection_name, top_talkers.Name, stored_top_talkers)
+
+	if err != nil {
+		return err
+	}
+
+	result.TopTalkersStored = found
+
+	if !found {
+		stored_top_talkers = nil
+	}
+
+	result.TopTalkersChanges, err = compare_documents(stored_top_talkers, top_talkers)
+
+	return err
+}
+
+// Prints all results in json or table format and returns exit code
+func (report *dry_run_report) print(output io.Writer, format string) int {
+	if format == "json" {
+		json_output, err := json.MarshalIndent(report.results, "", "  ")
+
+		if err != nil {
+			fast_logger.Printf("Cannot encode JSON: %v", err)
+			return 1
+		}
+
+		fmt.Fprintln(output, string(json_output))
+		return 0
+	}
+
+	table := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+
+	for _, result := range report.results {
+		fmt.Fprintf(table, "Hostgroup %s\n", result.Name)
+
+		if result.Baseline != nil {
+			computed_values, _ := flatten_document(result.Baseline)
+			stored_values := map[string]interface{}{}
+
+			for _, change := range result.BaselineChanges {
+				stored_values[change.Path] = change.Stored
+			}
+
+			fmt.Fprintf(table, "\nBaseline\tStored\tComputed\t\n")
+
+			for _, path := range sorted_keys(computed_values) {
+				stored_value, changed := stored_values[path]
+
+				if !changed {
+					stored_value = computed_values[path]
+				}
+
+				marker := ""
+
+				if changed {
+					marker = "*"
+				}
+
+				fmt.Fprintf(table, "%s\t%s\t%s\t%s\n", path, format_document_value(stored_value), format_document_value(computed_values[path]), marker)
+			}
+		}
+
+		if result.SeasonalBaseline != nil {
+			fmt.Fprintf(table, "\nSeasonal baseline: %d changes\tStored\tComputed\t\n", len(result.SeasonalBaselineChanges))
+
+			for _, change := range result.SeasonalBaselineChanges {
+				fmt.Fprintf(table, "%s\t%s\t%s\t\n", change.Path, format_document_value(change.Stored), format_document_value(change.Computed))
+			}
+		}
+
+		if result.HostBaselines != nil {
+			fmt.Fprintf(table, "\nHost baselines: %d hosts\tSamples\tIncoming bits p95\tOutgoing bits p95\n", len(result.HostBaselines))
+
+			for _, host_baseline := range result.HostBaselines {
+				fmt.Fprintf(table, "%s\t%d\t%d\t%d\n", host_baseline.Host, host_baseline.Metadata.SampleCount, host_baseline.Incoming.Bits.Quantile95, host_baseline.Outgoing.Bits.Quantile95)
+			}
+		}
+
+		if result.Recommendations != nil {
+			fmt.Fprintf(table, "\nRecommended threshold\tValue\tUnit\tReasoning\n")
+
+			for _, recommendation := range result.Recommendations.Thresholds {
+				reasoning := recommendation.Reasoning
+
+				explanation := fmt.Sprintf("%s %s %s %d x %g", reasoning.Direction, reasoning.Metric, reasoning.Statistic, reasoning.StatisticValue, reasoning.Multiplier)
+
+				if reasoning.FloorApplied {
+					explanation += fmt.Sprintf(", floor %d", reasoning.Floor)
+				}
+
+				fmt.Fprintf(table, "%s\t%d\t%s\t%s\n", recommendation.Threshold, recommendation.Value, recommendation.Unit, explanation)
+			}
+		}
+
+		if result.TopTalkers != nil {
+			fmt.Fprintf(table, "\nTop talkers: %d changes\tStored\tComputed\t\n", len(result.TopTalkersChanges))
+
+			for _, change := range result.TopTalkersChanges {
+				fmt.Fprintf(table, "%s\t%s\t%s\t\n", change.Path, format_document_value(change.Stored), format_document_value(change.Computed))
+			}
+		}
+
+		fmt.Fprintf(table, "\n")
+	}
+
+	table.Flush()
+
+	return 0
+}
+
+// Returns list of changed fields between two documents, stored document can be nil
+func compare_documents(stored interface{}, computed interface{}) ([]document_change, error) {
+	stored_values := map[string]interface{}{}
+
+	if stored != nil {
+		var err error
+
+		stored_values, err = flatten_document(stored)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	computed_values, err := flatten_document(computed)
+
+	if err != nil {
+		return nil, err
+	}
+
+	all_values := map[string]interface{}{}
+
+	for path := range stored_values {
+		all_values[path] = nil
+	}
+
+	for path := range computed_values {
+		all_values[path] = nil
+	}
+
+	changes := []document_change{}
+
+	for _, path := range sorted_keys(all_values) {
+		stored_value, have_stored := stored_values[path]
+		computed_value, have_computed := computed_values[path]
+
+		if have_stored && have_computed && stored_value == computed_value {
+			continue
+		}
+
+		changes = append(changes, document_change{Path: path, Stored: stored_value, Computed: computed_value})
+	}
+
+	return changes, nil
+}
+
+// Converts document into map where keys are dot separated paths to all scalar values
+func flatten_document(document interface{}) (map[string]interface{}, error) {
+	json_document, err := json.Marshal(document)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// We keep numbers as is to avoid float64 rounding for large counters
+	decoder := json.NewDecoder(bytes.NewReader(json_document))
+	decoder.UseNumber()
+
+	var decoded interface{}
+
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, err
+	}
+
+	flat_document := map[string]interface{}{}
+	flatten_value("", decoded, flat_document)
+
+	return flat_document, nil
+}
+
+// Walks over decoded JSON value and puts all scalar values into flat_document
+func flatten_value(path string, value interface{}, flat_document map[string]interface{}) {
+	switch typed_value := value.(type) {
+	case map[string]interface{}:
+		for key, element := range typed_value {
+			flatten_value(join_document_path(path, key), element, flat_document)
+		}
+	case []interface{}:
+		for index, element := range typed_value {
+			flatten_value(join_document_path(path, strconv.Itoa(index)), element, flat_document)
+		}
+	default:
+		flat_document[path] = typed_value
+	}
+}
+
+func join_document_path(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+
+	return prefix + "." + key
+}
+
+// Formats scalar value for table output
+func format_document_value(value interface{}) string {
+	if value == nil {
+		return "-"
+	}
+
+	return fmt.Sprint(value)
+}
+
+// Returns sorted keys of map
+func sorted_keys(values map[string]interface{}) []string {
+	keys := make([]string, 0, len(values))
+
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Time range when host or network was attacked or banned, we do not use traffic from it for baselines
+type AttackExclusion struct {
+	// IP address or network in CIDR format, empty value means all hosts
+	Host string `bson:"host" json:"host"`
+
+	Start time.Time `bson:"start" json:"start"`
+	End   time.Time `bson:"end" json:"end"`
+
+	Comment string `bson:"comment,omitempty" json:"comment,omitempty"`
+}
+
+// Exclusions which we loaded for current run
+var attack_exclusions []AttackExclusion
+
+// Checks that exclusion is safe to use in query
+func validate_attack_exclusion(exclusion AttackExclusion) error {
+	if exclusion.Host != "" && net.ParseIP(exclusion.Host) == nil {
+		if _, _, err := net.ParseCIDR(exclusion.Host); err != nil {
+			return fmt.Errorf("host %s is neither IP address nor network", exclusion.Host)
+		}
+	}
+
+	if !exclusion.End.After(exclusion.Start) {
+		return fmt.Errorf("end %s must be after start %s", exclusion.End.Format(time.RFC3339), exclusion.Start.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Returns host of exclusion in same form as FastNetMon writes it into host column
+// We compare host column as string and 2001:DB8::0001 must match 2001:db8::1
+func normalise_attack_exclusion_host(host string) string {
+	if host == "" {
+		return host
+	}
+
+	if address := net.ParseIP(host); address != nil {
+		return address.String()
+	}
+
+	if _, network, err := net.ParseCIDR(host); err == nil {
+		return network.String()
+	}
+
+	return host
+}
+
+// Reads list of exclusions from JSON file
+func read_attack_exclusions_file(file_path string) ([]AttackExclusion, error) {
+	file_as_array, err := ioutil.ReadFile(file_path)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read exclusions file %s: %w", file_path, err)
+	}
+
+	exclusions := []AttackExclusion{}
+
+	err = json.Unmarshal(file_as_array, &exclusions)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot decode exclusions file %s: %w", file_path, err)
+	}
+
+	return exclusions, nil
+}
+
+// Reads exclusions which overlap with window from MongoDB collection
+func read_attack_exclusions_collection(ctx context.Context, mongo_client *mongo.Client, collection_name string, window calculation_window) ([]AttackExclusion, error) {
+	exclusions_collection := mongo_client.Database(global_db_conf.Db_name).Collection(collection_name)
+
+	filter := bson.D{
+		{Key: "start", Value: bson.D{{Key: "$lte", Value: window.end}}},
+		{Key: "end", Value: bson.D{{Key: "$gte", Value: window.start}}},
+	}
+
+	cursor, err := exclusions_collection.Find(ctx, filter)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load exclusions from MongoDB: %w", err)
+	}
+
+	exclusions := []AttackExclusion{}
+
+	if err = cursor.All(ctx, &exclusions); err != nil {
+		return nil, fmt.Errorf("Cannot retrieve exclusions from MongoDB: %w", err)
+	}
+
+	return exclusions, nil
+}
+
+// Loads exclusions from MongoDB collection and file from configuration into attack_exclusions
+// We skip invalid exclusions and exclusions which do not overlap with window
+func load_attack_exclusions(ctx context.Context, mongo_client *mongo.Client, window calculation_window) error {
+	attack_exclusions = nil
+
+	loaded_exclusions := []AttackExclusion{}
+
+	if configuration.ExclusionsCollection != "" {
+		if mongo_client == nil {
+			return fmt.Errorf("exclusions_collection requires mongodb storage backend")
+		}
+
+		exclusions, err := read_attack_exclusions_collection(ctx, mongo_client, configuration.ExclusionsCollection, window)
+
+		if err != nil {
+			return err
+		}
+
+		loaded_exclusions = append(loaded_exclusions, exclusions...)
+	}
+
+	if configuration.ExclusionsFile != "" {
+		exclusions, err := read_attack_exclusions_file(configuration.ExclusionsFile)
+
+		if err != nil {
+			return err
+		}
+
+		loaded_exclusions = append(loaded_exclusions, exclusions...)
+	}
+
+	for _, exclusion := range loaded_exclusions {
+		if err := validate_attack_exclusion(exclusion); err != nil {
+			fast_logger.Printf("Skip bad exclusion: %v", err)
+			continue
+		}
+
+		if exclusion.Start.After(window.end) || exclusion.End.Before(window.start) {
+			continue
+		}
+
+		exclusion.Host = normalise_attack_exclusion_host(exclusion.Host)
+
+		attack_exclusions = append(attack_exclusions, exclusion)
+	}
+
+	if len(loaded_exclusions) > 0 {
+		fast_logger.Printf("Loaded %d exclusions for calculation period", len(attack_exclusions))
+	}
+
+	return nil
+}
+
+// Generates WHERE clause which removes samples from excluded time ranges
+// When we have no information about hosts we can apply only exclusions for all hosts
+func generate_exclusions_where_clause(have_hosts bool) built_query {
+	conditions := []built_query{}
+
+	for _, exclusion := range attack_exclusions {
+		time_condition := fmt.Sprintf("metricDateTime >= toDateTime(%d) AND metricDateTime <= toDateTime(%d)", exclusion.Start.Unix(), exclusion.End.Unix())
+
+		if exclusion.Host == "" {
+			conditions = append(conditions, query_text(fmt.Sprintf("NOT (%s)", time_condition)))
+			continue
+		}
+
+		if !have_hosts {
+			continue
+		}
+
+		// Exclusions come from file or MongoDB and we pass host as bound parameter
+		host_condition := format_query("host = %s", bind_query_parameter(exclusion.Host))
+
+		if strings.Contains(exclusion.Host, "/") {
+			host_condition = format_query("isIPAddressInRange(host, %s)", bind_query_parameter(exclusion.Host))
+		}
+
+		conditions = append(conditions, format_query("NOT (%s AND %s)", query_text(time_condition), host_condition))
+	}
+
+	if len(conditions) == 0 {
+		return query_text("1 = 1")
+	}
+
+	return join_queries(conditions, " AND ")
+}
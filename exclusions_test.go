@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNormaliseAttackExclusionHost(t *testing.T) {
+	test_cases := []struct {
+		host     string
+		expected string
+	}{
+		{"", ""},
+		{"192.0.2.10", "192.0.2.10"},
+		{"2001:DB8::0001", "2001:db8::1"},
+		{"2001:0db8:0000:0000:0000:0000:0000:0010", "2001:db8::10"},
+		{"::ffff:192.0.2.10", "192.0.2.10"},
+		{"198.51.100.7/24", "198.51.100.0/24"},
+		{"2001:DB8:10::1/48", "2001:db8:10::/48"},
+	}
+
+	for _, test_case := range test_cases {
+		if host := normalise_attack_exclusion_host(test_case.host); host != test_case.expected {
+			t.Errorf("Host %s must become %s, we have %s", test_case.host, test_case.expected, host)
+		}
+	}
+}
+
+func TestLoadAttackExclusionsNormalisesHosts(t *testing.T) {
+	directory, err := ioutil.TempDir("", "baseline_exporter")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(directory)
+
+	exclusions_file := filepath.Join(directory, "exclusions.json")
+
+	err = ioutil.WriteFile(exclusions_file, []byte(`[
+		{"host": "2001:DB8::0001", "start": "2022-04-01T00:00:00Z", "end": "2022-04-01T01:00:00Z"},
+		{"host": "not a host", "start": "2022-04-01T00:00:00Z", "end": "2022-04-01T01:00:00Z"},
+		{"host": "192.0.2.10", "start": "2022-01-01T00:00:00Z", "end": "2022-01-01T01:00:00Z"}
+	]`), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configuration = BaselineExporterConfiguration{ExclusionsFile: exclusions_file, CalculationPeriod: 604800}
+
+	err = load_attack_exclusions(context.Background(), nil, new_calculation_window(time.Date(2022, 4, 7, 13, 50, 50, 0, time.UTC)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(attack_exclusions) != 1 || attack_exclusions[0].Host != "2001:db8::1" {
+		t.Errorf("We must keep only valid exclusion in window with normalised host, we have %+v", attack_exclusions)
+	}
+}
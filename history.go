@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDB collection where we keep all computed baselines
+const hostgroups_baseline_history_collection_name = "baseline_exporter_hostgroups_baseline_history"
+
+// Name of TTL index which removes old snapshots from history
+const baseline_history_ttl_index_name = "computed_at_ttl"
+
+// Snapshot of hostgroup baseline in history collection
+type BaselineHistoryEntry struct {
+	ComputedAt time.Time `bson:"computed_at" json:"computed_at"`
+
+	BaselineStructure `bson:",inline"`
+}
+
+// Creates indexes for history collection and applies retention from configuration
+func ensure_baseline_history_indexes(ctx context.Context, mongo_client *mongo.Client) error {
+	history_collection := mongo_client.Database(global_db_conf.Db_name).Collection(hostgroups_baseline_history_collection_name)
+
+	_, err := history_collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "name", Value: 1}, {Key: "computed_at", Value: -1}},
+	})
+
+	if err != nil {
+		return fmt.Errorf("Cannot create index for history: %w", err)
+	}
+
+	// Zero retention means that we keep history forever
+	if configuration.HistoryRetention <= 0 {
+		_, err = history_collection.Indexes().DropOne(ctx, baseline_history_ttl_index_name)
+
+		var command_error mongo.CommandError
+
+		// 27 is IndexNotFound, 26 is NamespaceNotFound
+		if err != nil && errors.As(err, &command_error) && (command_error.Code == 27 || command_error.Code == 26) {
+			return nil
+		}
+
+		return err
+	}
+
+	if configuration.HistoryRetention > math.MaxInt32 {
+		return fmt.Errorf("history_retention %d is too large", configuration.HistoryRetention)
+	}
+
+	_, err = history_collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "computed_at", Value: 1}},
+		Options: options.Index().SetName(baseline_history_ttl_index_name).SetExpireAfterSeconds(int32(configuration.HistoryRetention)),
+	})
+
+	var command_error mongo.CommandError
+
+	// 85 is IndexOptionsConflict, it happens when retention was changed and we need to update existing index
+	if err != nil && errors.As(err, &command_error) && command_error.Code == 85 {
+		err = mongo_client.Database(global_db_conf.Db_name).RunCommand(ctx, bson.D{
+			{Key: "collMod", Value: hostgroups_baseline_history_collection_name},
+			{Key: "index", Value: bson.D{
+				{Key: "name", Value: baseline_history_ttl_index_name},
+				{Key: "expireAfterSeconds", Value: configuration.HistoryRetention},
+			}},
+		}).Err()
+	}
+
+	if err != nil {
+		return fmt.Errorf("Cannot configure retention for history: %w", err)
+	}
+
+	return nil
+}
+
+// Appends snapshot of baseline to history collection
+// We upsert by hostgroup and computation time because we retry writes and first attempt may succeed without reply
+func append_baseline_history(ctx context.Context, mongo_client *mongo.Client, baseline *BaselineStructure) error {
+	history_collection := mongo_client.Database(global_db_conf.Db_name).Collection(hostgroups_baseline_history_collection_name)
+
+	filter := bson.D{{Key: "name", Value: baseline.Name}, {Key: "computed_at", Value: baseline.Metadata.ComputedAt}}
+
+	// TTL index works only with top level fields
+	_, err := history_collection.ReplaceOne(ctx, filter, BaselineHistoryEntry{ComputedAt: baseline.Metadata.ComputedAt, BaselineStructure: *baseline}, options.Replace().SetUpsert(true))
+
+	return err
+}
+
+// Returns snapshots of hostgroup baseline computed in specified time range, newest first
+// Zero since or until means that range is open from that side, zero limit means no limit
+func read_baseline_history(ctx context.Context, mongo_client *mongo.Client, hostgroup_name string, since time.Time, until time.Time, limit int64) ([]BaselineHistoryEntry, error) {
+	history_collection := mongo_client.Database(global_db_conf.Db_name).Collection(hostgroups_baseline_history_collection_name)
+
+	filter := bson.D{{Key: "name", Value: hostgroup_name}}
+
+	time_filter := bson.D{}
+
+	if !since.IsZero() {
+		time_filter = append(time_filter, bson.E{Key: "$gte", Value: since})
+	}
+
+	if !until.IsZero() {
+		time_filter = append(time_filter, bson.E{Key: "$lte", Value: until})
+	}
+
+	if len(time_filter) > 0 {
+		filter = append(filter, bson.E{Key: "computed_at", Value: time_filter})
+	}
+
+	find_options := options.Find().SetSort(bson.D{{Key: "computed_at", Value: -1}})
+
+	if limit > 0 {
+		find_options.SetLimit(limit)
+	}
+
+	cursor, err := history_collection.Find(ctx, filter, find_options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	history := []BaselineHistoryEntry{}
+
+	if err = cursor.All(ctx, &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// Parses time in RFC3339 format or as duration before now like 72h
+func parse_time_or_duration(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	parsed_time, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("'%s' is neither RFC3339 time nor duration", value)
+	}
+
+	return parsed_time, nil
+}
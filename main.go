@@ -4,19 +4,19 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
-	"net"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
-	_ "github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go"
 	"github.com/pkg/errors"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
@@ -28,13 +28,127 @@ type BaselineExporterConfiguration struct {
 	CalculationPeriod int64 `json:"calculaton_period"`
 
 	// Function used to find from traffic of all hosts in network: avg or max
+	// Deprecated: it only adds matching statistic to statistics list
 	AggregationFunction string `json:"aggregation_function"`
 
+	// Statistics which we calculate for every metric: p50, p90, p95, p99, p99.9, max, avg, stddev
+	// p95 is always calculated because FastNetMon reads quantile_95
+	Statistics []string `json:"statistics"`
+
 	// Number of top talkers
 	NumberOfTopTalkers uint64 `json:"number_of_top_talkers"`
 
 	// info is default but can be debug
 	LogLevel string `json:"log_level"`
+
+	// Interval between runs in daemon mode in seconds, 1 hour by default
+	DaemonInterval int64 `json:"daemon_interval"`
+
+	// Cron expression for daemon mode: minute hour day_of_month month day_of_week
+	// When it's set it overrides daemon_interval
+	DaemonSchedule string `json:"daemon_schedule"`
+
+	// Enables calculation of baselines per day of week and hour of day
+	SeasonalBaseline bool `json:"seasonal_baseline"`
+
+	// Size of hour of day bucket for seasonal baseline in hours, it must divide 24
+	SeasonalBucketHours int64 `json:"seasonal_bucket_hours"`
+
+	// Time zone which we use to find day of week and hour of day, UTC by default
+	SeasonalTimezone string `json:"seasonal_timezone"`
+
+	// Clickhouse table with traffic per hostgroup which we use for hostgroups with total calculation method
+	// When it's empty we sum traffic of all hosts from host_metrics
+	HostgroupMetricsTable string `json:"hostgroup_metrics_table"`
+
+	// Enables baselines for every host
+	PerHostBaseline bool `json:"per_host_baseline"`
+
+	// Maximum number of hosts per hostgroup for per host baselines, we keep hosts with largest traffic
+	PerHostBaselineMaxHosts uint64 `json:"per_host_baseline_max_hosts"`
+
+	// Hosts with smaller number of samples in calculation period are ignored
+	PerHostBaselineMinSamples uint64 `json:"per_host_baseline_min_samples"`
+
+	// Enables generation of recommended FastNetMon thresholds from baselines
+	ThresholdRecommendations bool `json:"threshold_recommendations"`
+
+	// Rules which we use to calculate recommended thresholds, by default we have rules for all FastNetMon thresholds
+	ThresholdRules []ThresholdRule `json:"threshold_rules"`
+
+	// audit-thresholds reports thresholds which are less than this percentage above baseline, 20% by default
+	ThresholdAuditHeadroom float64 `json:"threshold_audit_headroom"`
+
+	// Rejection of samples with abnormal traffic: median, mad or empty value to disable it
+	// median drops samples above outlier_median_multiplier x median
+	// mad drops samples further than outlier_mad_multiplier x median absolute deviation from median
+	OutlierRejection        string  `json:"outlier_rejection"`
+	OutlierMedianMultiplier float64 `json:"outlier_median_multiplier"`
+	OutlierMadMultiplier    float64 `json:"outlier_mad_multiplier"`
+
+	// MongoDB collection with time ranges when hosts were attacked or banned, we do not use traffic from them
+	ExclusionsCollection string `json:"exclusions_collection"`
+
+	// Local JSON file with same time ranges
+	ExclusionsFile string `json:"exclusions_file"`
+
+	// Planned events which we remove from calculation window
+	MaintenanceWindows []MaintenanceWindow `json:"maintenance_windows"`
+
+	// Local JSON file with list of maintenance windows in same format
+	MaintenanceFile string `json:"maintenance_file"`
+
+	// How long we keep baseline snapshots in history collection in seconds, 90 days by default
+	// Zero value means that we keep them forever
+	HistoryRetention int64 `json:"history_retention"`
+
+	// Number of hostgroups which we process in parallel, 1 by default
+	Workers int64 `json:"workers"`
+
+	// Maximum duration of single Clickhouse query in seconds, 600 by default, 0 disables limit
+	QueryTimeout int64 `json:"query_timeout"`
+
+	// Maximum duration of all queries for single hostgroup in seconds, 0 by default which disables limit
+	HostgroupTimeout int64 `json:"hostgroup_timeout"`
+
+	// Number of retries after transient Clickhouse and MongoDB errors, 3 by default
+	Retries int64 `json:"retries"`
+
+	// Delay before first retry in milliseconds, it doubles after every retry up to retry_max_delay
+	RetryDelay    int64 `json:"retry_delay"`
+	RetryMaxDelay int64 `json:"retry_max_delay"`
+
+	// When hostgroup filter has more address ranges we pass its networks to Clickhouse as external table, 1000 by default
+	NetworkTableThreshold int64 `json:"network_table_threshold"`
+
+	// Storage for FastNetMon configuration and results: mongodb or file
+	// When it's empty we use storage_backend from FastNetMon configuration
+	StorageBackend string `json:"storage_backend"`
+
+	// Directory with JSON files for file storage backend
+	StorageDirectory string `json:"storage_directory"`
+
+	// Clickhouse connection, empty values mean that we use values from FastNetMon configuration
+	ClickhouseHost     string `json:"clickhouse_host"`
+	ClickhousePort     uint   `json:"clickhouse_port"`
+	ClickhouseUsername string `json:"clickhouse_username"`
+	ClickhousePassword string `json:"clickhouse_password"`
+	ClickhouseDatabase string `json:"clickhouse_database"`
+
+	ClickhouseTLS         bool   `json:"clickhouse_tls"`
+	ClickhouseTLSCAFile   string `json:"clickhouse_tls_ca_file"`
+	ClickhouseTLSCertFile string `json:"clickhouse_tls_cert_file"`
+	ClickhouseTLSKeyFile  string `json:"clickhouse_tls_key_file"`
+	ClickhouseTLSInsecure bool   `json:"clickhouse_tls_insecure"`
+
+	// Enables LZ4 compression of data blocks
+	ClickhouseCompress bool `json:"clickhouse_compress"`
+
+	// Servers in host:port format which we try when main server is not available
+	ClickhouseAltHosts []string `json:"clickhouse_alt_hosts"`
+
+	// Clickhouse settings for all queries like max_execution_time, values are strings
+	ClickhouseSettings map[string]string `json:"clickhouse_settings"`
 }
 
 // Configuration
@@ -46,10 +160,42 @@ type db_configuration_t struct {
 	Db_name           string `json:"mongodb_database_name"`
 	Auth_source       string `json:"mongodb_auth_source"`
 	Mongodb_port      uint   `json:"mongodb_port"`
+
+	// Complete connection URI, all other MongoDB options are ignored when it's set
+	Mongodb_uri string `json:"mongodb_uri"`
+
+	// List of servers in host:port format, we use mongodb_host and mongodb_port when it's empty
+	Mongodb_hosts       []string `json:"mongodb_hosts"`
+	Mongodb_replica_set string   `json:"mongodb_replica_set"`
+
+	Mongodb_tls           bool   `json:"mongodb_tls"`
+	Mongodb_tls_ca_file   string `json:"mongodb_tls_ca_file"`
+	Mongodb_tls_cert_file string `json:"mongodb_tls_cert_file"`
+	Mongodb_tls_key_file  string `json:"mongodb_tls_key_file"`
+	Mongodb_tls_insecure  bool   `json:"mongodb_tls_insecure"`
+
+	// Timeouts in seconds, 0 means driver default
+	Mongodb_connect_timeout uint `json:"mongodb_connect_timeout"`
+	Mongodb_socket_timeout  uint `json:"mongodb_socket_timeout"`
+
+	// Read concern level: local, available, majority, linearizable, snapshot
+	Mongodb_read_concern string `json:"mongodb_read_concern"`
+
+	// Write concern: majority or number of nodes
+	Mongodb_write_concern string `json:"mongodb_write_concern"`
 }
 
+// We always have quantile_95, other statistics are present only when they're enabled in configuration
 type TrafficValue struct {
 	Quantile95 int64 `bson:"quantile_95" json:"quantile_95"`
+
+	Quantile50   *int64 `bson:"quantile_50,omitempty" json:"quantile_50,omitempty"`
+	Quantile90   *int64 `bson:"quantile_90,omitempty" json:"quantile_90,omitempty"`
+	Quantile99   *int64 `bson:"quantile_99,omitempty" json:"quantile_99,omitempty"`
+	Quantile99_9 *int64 `bson:"quantile_99_9,omitempty" json:"quantile_99_9,omitempty"`
+	Max          *int64 `bson:"max,omitempty" json:"max,omitempty"`
+	Avg          *int64 `bson:"avg,omitempty" json:"avg,omitempty"`
+	Stddev       *int64 `bson:"stddev,omitempty" json:"stddev,omitempty"`
 }
 
 type TopTalker struct {
@@ -78,11 +224,37 @@ type TrafficBaseline struct {
 	Tcp_syn_bits    TrafficValue `bson:"tcp_syn_bits" json:"tcp_syn_bits"`
 }
 
+// Describes how and from which data we computed document
+type CalculationMetadata struct {
+	ComputedAt  time.Time `bson:"computed_at" json:"computed_at"`
+	WindowStart time.Time `bson:"window_start" json:"window_start"`
+	WindowEnd   time.Time `bson:"window_end" json:"window_end"`
+
+	// Number of rows from host_metrics and number of distinct hosts in them
+	SampleCount   int64 `bson:"sample_count" json:"sample_count"`
+	DistinctHosts int64 `bson:"distinct_hosts" json:"distinct_hosts"`
+
+	AggregationFunction string   `bson:"aggregation_function" json:"aggregation_function"`
+	CalculationMethod   string   `bson:"calculation_method,omitempty" json:"calculation_method,omitempty"`
+	Statistics          []string `bson:"statistics,omitempty" json:"statistics,omitempty"`
+	OutlierRejection    string   `bson:"outlier_rejection,omitempty" json:"outlier_rejection,omitempty"`
+
+	// Number of excluded time ranges which overlap with window
+	ExcludedRanges int64 `bson:"excluded_ranges,omitempty" json:"excluded_ranges,omitempty"`
+
+	// Names of maintenance windows which we removed from calculation window
+	MaintenanceWindows []string `bson:"maintenance_windows,omitempty" json:"maintenance_windows,omitempty"`
+
+	ExporterVersion string   `bson:"exporter_version" json:"exporter_version"`
+	Networks        []string `bson:"networks" json:"networks"`
+}
+
 // Structure to push into MongoDB
 type BaselineStructure struct {
-	Name     string          `bson:"name" json:"name"`
-	Incoming TrafficBaseline `bson:"incoming" json:"incoming" `
-	Outgoing TrafficBaseline `bson:"outgoing" json:"outgoing"`
+	Name     string              `bson:"name" json:"name"`
+	Incoming TrafficBaseline     `bson:"incoming" json:"incoming" `
+	Outgoing TrafficBaseline     `bson:"outgoing" json:"outgoing"`
+	Metadata CalculationMetadata `bson:"metadata" json:"metadata"`
 }
 
 type AllTopTalkers struct {
@@ -107,13 +279,33 @@ type AllTopTalkers struct {
 
 // Structure to store top talkers in MongoDB
 type TopTalkersStructure struct {
-	Name     string        `bson:"name" json:"name"`
-	Incoming AllTopTalkers `bson:"incoming" json:"incoming"`
-	Outgoing AllTopTalkers `bson:"outgoing" json:"outgoing"`
+	Name     string              `bson:"name" json:"name"`
+	Incoming AllTopTalkers       `bson:"incoming" json:"incoming"`
+	Outgoing AllTopTalkers       `bson:"outgoing" json:"outgoing"`
+	Metadata CalculationMetadata `bson:"metadata" json:"metadata"`
+	// Errors for metrics which we could not calculate, keyed by metric name
+	Errors map[string]string `bson:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// Time range of traffic data which we use for calculation
+type calculation_window struct {
+	start time.Time
+	end   time.Time
+}
+
+// Returns window which ends at specified time and has length from configuration
+func new_calculation_window(end time.Time) calculation_window {
+	// Clickhouse works with seconds
+	end = end.Truncate(time.Second)
+
+	return calculation_window{start: end.Add(-time.Duration(configuration.CalculationPeriod) * time.Second), end: end}
 }
 
 var configuration BaselineExporterConfiguration
 
+// Version of tool, we set it during build: go build -ldflags "-X main.exporter_version=1.0.0"
+var exporter_version = "dev"
+
 // Default path to tool configuration
 var configuration_path = "/etc/fastnetmon/fastnetmon.conf"
 
@@ -121,6 +313,10 @@ var baseline_exporter_configuration_path = "/etc/fastnetmon/baseline_exporter.co
 
 var log_path = "/var/log/fastnetmon/baseline_exporter.log"
 
+// MongoDB collections where we store results
+const hostgroups_baseline_collection_name = "baseline_exporter_hostgroups_baseline"
+const hostgroups_top_talkers_collection_name = "baseline_exporter_hostgroups_top_talkers"
+
 // Default data to connect to MongoDB
 var global_db_conf = db_configuration_t{Database_address: "127.0.0.1", Db_name: "fastnetmon", Database_username: "fastnetmon_user", Auth_source: "admin", Mongodb_port: 27017, StorageBackend: "mongodb"}
 
@@ -138,6 +334,32 @@ type Ban_settings_t struct {
 	Name               string   `bson:"name" datastore:"name" json:"name" fastnetmon_type:"string" fastnetmon_description:"Name of host group" deprecated:"false" sensitive:"false"`
 	Networks           []string `bson:"networks" datastore:"networks" json:"networks" fastnetmon_type:"cidr_networks_list" fastnetmon_description:"List of networks which belong to this group" deprecated:"false" sensitive:"false"`
 	Calculation_method string   `bson:"calculation_method" datastore:"calculation_method" json:"calculation_method" fastnetmon_type:"string" fastnetmon_description:"Traffic calculation method for host group: total or per_host (or empty value)" deprecated:"false" sensitive:"false"`
+
+	// Thresholds for incoming traffic, we change them from recommendations
+	Threshold_mbps         uint `bson:"threshold_mbps" datastore:"threshold_mbps" json:"threshold_mbps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for all incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_pps          uint `bson:"threshold_pps" datastore:"threshold_pps" json:"threshold_pps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for all incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_flows        uint `bson:"threshold_flows" datastore:"threshold_flows" json:"threshold_flows" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in flows per second for all incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_mbps     uint `bson:"threshold_tcp_mbps" datastore:"threshold_tcp_mbps" json:"threshold_tcp_mbps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for TCP bits incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_udp_mbps     uint `bson:"threshold_udp_mbps" datastore:"threshold_udp_mbps" json:"threshold_udp_mbps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for UDP bits incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_icmp_mbps    uint `bson:"threshold_icmp_mbps" datastore:"threshold_icmp_mbps" json:"threshold_icmp_mbps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for ICMP bits incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_pps      uint `bson:"threshold_tcp_pps" datastore:"threshold_tcp_pps" json:"threshold_tcp_pps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for TCP packets incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_udp_pps      uint `bson:"threshold_udp_pps" datastore:"threshold_udp_pps" json:"threshold_udp_pps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for UDP packets incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_icmp_pps     uint `bson:"threshold_icmp_pps" datastore:"threshold_icmp_pps" json:"threshold_icmp_pps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for ICMP packets incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_syn_mbps uint `bson:"threshold_tcp_syn_mbps" datastore:"threshold_tcp_syn_mbps" json:"threshold_tcp_syn_mbps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for TCP SYN bits incoming traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_syn_pps  uint `bson:"threshold_tcp_syn_pps" datastore:"threshold_tcp_syn_pps" json:"threshold_tcp_syn_pps" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for TCP SYN packets incoming traffic" deprecated:"false" sensitive:"false"`
+
+	// Thresholds for outgoing traffic, we change them from recommendations
+	Threshold_mbps_outgoing         uint `bson:"threshold_mbps_outgoing" datastore:"threshold_mbps_outgoing" json:"threshold_mbps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for all outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_pps_outgoing          uint `bson:"threshold_pps_outgoing" datastore:"threshold_pps_outgoing" json:"threshold_pps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for all outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_flows_outgoing        uint `bson:"threshold_flows_outgoing" datastore:"threshold_flows_outgoing" json:"threshold_flows_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in flows per second for all outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_mbps_outgoing     uint `bson:"threshold_tcp_mbps_outgoing" datastore:"threshold_tcp_mbps_outgoing" json:"threshold_tcp_mbps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for TCP bits outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_udp_mbps_outgoing     uint `bson:"threshold_udp_mbps_outgoing" datastore:"threshold_udp_mbps_outgoing" json:"threshold_udp_mbps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for UDP bits outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_icmp_mbps_outgoing    uint `bson:"threshold_icmp_mbps_outgoing" datastore:"threshold_icmp_mbps_outgoing" json:"threshold_icmp_mbps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for ICMP bits outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_pps_outgoing      uint `bson:"threshold_tcp_pps_outgoing" datastore:"threshold_tcp_pps_outgoing" json:"threshold_tcp_pps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for TCP packets outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_udp_pps_outgoing      uint `bson:"threshold_udp_pps_outgoing" datastore:"threshold_udp_pps_outgoing" json:"threshold_udp_pps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for UDP packets outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_icmp_pps_outgoing     uint `bson:"threshold_icmp_pps_outgoing" datastore:"threshold_icmp_pps_outgoing" json:"threshold_icmp_pps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for ICMP packets outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_syn_mbps_outgoing uint `bson:"threshold_tcp_syn_mbps_outgoing" datastore:"threshold_tcp_syn_mbps_outgoing" json:"threshold_tcp_syn_mbps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in megabits per second for TCP SYN bits outgoing traffic" deprecated:"false" sensitive:"false"`
+	Threshold_tcp_syn_pps_outgoing  uint `bson:"threshold_tcp_syn_pps_outgoing" datastore:"threshold_tcp_syn_pps_outgoing" json:"threshold_tcp_syn_pps_outgoing" fastnetmon_type:"positive_integer" fastnetmon_description:"Threshold in packets per second for TCP SYN packets outgoing traffic" deprecated:"false" sensitive:"false"`
 }
 
 // Mongo
@@ -145,138 +367,248 @@ var (
 	current_global_conf Fastnetmon_configuration_t
 )
 
+// Database name passed from command line, it overrides one from FastNetMon configuration
+var mongodb_database_override string
+
 func main() {
+	flag.Usage = print_usage
+
+	flag.StringVar(&baseline_exporter_configuration_path, "config", baseline_exporter_configuration_path, "Path to baseline exporter configuration file")
+	flag.StringVar(&configuration_path, "fastnetmon-config", configuration_path, "Path to FastNetMon configuration file with MongoDB connection details")
+	flag.StringVar(&log_path, "log", log_path, "Path to log file")
+	flag.StringVar(&mongodb_database_override, "mongodb-database", "", "MongoDB database name, overrides value from FastNetMon configuration")
+
+	flag.Parse()
+
+	// We run baselines generation when command is not specified to keep compatibility with cron jobs
+	command_name := "run"
+	command_arguments := []string{}
+
+	if flag.NArg() > 0 {
+		command_name = flag.Arg(0)
+		command_arguments = flag.Args()[1:]
+	}
+
+	command := find_cli_command(command_name)
+
+	if command == nil {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", command_name)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	os.Exit(command.handler(command_arguments))
+}
+
+// Stops tool when it's running without root rights
+func ensure_root_rights() {
 	if os.Geteuid() != 0 || os.Getegid() != 0 {
 		log.Fatal("Please run this tool with root rights (e.g. with sudo)")
 	}
+}
 
+// Sends our log to log file and to console
+// We use stderr as console for commands which print results to stdout
+func setup_logging(console io.Writer) *os.File {
 	log_file, err := os.OpenFile(log_path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 
 	if err != nil {
 		log.Fatalf("Cannot open log file: %v", err)
 	}
 
-	defer log_file.Close()
-
-	multi_writer := io.MultiWriter(os.Stdout, log_file)
+	multi_writer := io.MultiWriter(console, log_file)
 
 	fast_logger.SetOutput(multi_writer)
 
-	fast_logger.Print("Started Baseline exporter")
+	return log_file
+}
 
+// Loads baseline exporter configuration on top of default values
+func load_baseline_exporter_configuration() error {
 	// Calculate data over last 7 days by default
 	configuration.CalculationPeriod = 7 * 24 * 3600
 	configuration.AggregationFunction = "quantile(0.95)"
 	configuration.NumberOfTopTalkers = 100
 	configuration.LogLevel = "info"
+	configuration.DaemonInterval = 3600
+	configuration.HistoryRetention = 90 * 24 * 3600
+	configuration.SeasonalBucketHours = 1
+	configuration.SeasonalTimezone = "UTC"
+	configuration.PerHostBaselineMaxHosts = 1000
+	configuration.PerHostBaselineMinSamples = 60
+	configuration.ThresholdRules = default_threshold_rules()
+	configuration.ThresholdAuditHeadroom = 20
+	configuration.OutlierMedianMultiplier = 10
+	configuration.OutlierMadMultiplier = 5
+	configuration.Workers = 1
+	configuration.QueryTimeout = 600
+	configuration.Retries = 3
+	configuration.RetryDelay = 1000
+	configuration.RetryMaxDelay = 30000
+	configuration.NetworkTableThreshold = 1000
+
+	if !is_file_exists(baseline_exporter_configuration_path) {
+		fast_logger.Printf("We have no configuration file %s, start with default options", baseline_exporter_configuration_path)
+		return nil
+	}
 
-	if is_file_exists(baseline_exporter_configuration_path) {
-
-		file_as_array, err := ioutil.ReadFile(baseline_exporter_configuration_path)
+	file_as_array, err := ioutil.ReadFile(baseline_exporter_configuration_path)
 
-		if err != nil {
-			fast_logger.Fatalf("Could not read configuration file %s with error: %v", baseline_exporter_configuration_path, err)
-		}
+	if err != nil {
+		return fmt.Errorf("Could not read configuration file %s with error: %w", baseline_exporter_configuration_path, err)
+	}
 
-		// This command will override our default configuration
-		err = json.Unmarshal(file_as_array, &configuration)
+	// This command will override our default configuration
+	err = json.Unmarshal(file_as_array, &configuration)
 
-		if err != nil {
-			fast_logger.Fatalf("Could not read JSON configuration: %v", err)
-		}
+	if err != nil {
+		return fmt.Errorf("Could not read JSON configuration: %w", err)
+	}
 
-		fast_logger.Printf("Successfully read configuration file: %+v", configuration)
+	// We do not write password into log
+	logged_configuration := configuration
 
-	} else {
-		fast_logger.Printf("We have no configuration file %s, start with default options", baseline_exporter_configuration_path)
+	if logged_configuration.ClickhousePassword != "" {
+		logged_configuration.ClickhousePassword = "<hidden>"
 	}
 
-	fast_logger.Printf("Baseline exporter configuration: %+v", configuration)
+	fast_logger.Printf("Successfully read configuration file: %+v", logged_configuration)
 
+	return load_maintenance_calendar()
+}
+
+// Loads MongoDB connection details from FastNetMon configuration file
+func load_database_configuration() error {
 	// If we have custom file with configuration for MongoDB
 	if is_file_exists(configuration_path) {
 		file_as_array, err := ioutil.ReadFile(configuration_path)
 
 		if err != nil {
-			fast_logger.Fatal(fmt.Sprintf("Could not read configuration file from %s with error: %v", configuration_path, err))
+			return fmt.Errorf("Could not read configuration file from %s with error: %w", configuration_path, err)
 		}
 
 		// This command will override our default MongoDB configuration
 		err = json.Unmarshal(file_as_array, &global_db_conf)
 
 		if err != nil {
-			fast_logger.Fatalf("Could not read json configuration: %v", err)
+			return fmt.Errorf("Could not read json configuration: %w", err)
 		}
 
 		log.Printf("Read custom database configuration from %s", configuration_path)
 	}
 
-	fastnetmon_password_binary, _ := ioutil.ReadFile("/etc/fastnetmon/keychain/.mongo_fastnetmon_password")
+	if mongodb_database_override != "" {
+		global_db_conf.Db_name = mongodb_database_override
+	}
 
-	// Read password from file
-	global_db_conf.Database_password = string(fastnetmon_password_binary)
+	return nil
+}
 
-	mongodb_address := global_db_conf.Database_address
+// Connects to MongoDB and checks that connection works
+func connect_to_mongodb(ctx context.Context) (*mongo.Client, error) {
+	err := read_mongodb_password()
 
-	// Add brackets for IPv6 addresses
-	if strings.Contains(mongodb_address, ":") {
-		mongodb_address = "[" + mongodb_address + "]"
+	if err != nil {
+		return nil, err
 	}
 
-	mongodb_full_address := fmt.Sprintf("%s:%d", mongodb_address, global_db_conf.Mongodb_port)
+	client_options, err := mongodb_client_options()
 
-	// Estasblish connection to MongoDB usin new driver
-	mongo_uri := "mongodb://" + global_db_conf.Database_username + ":" + global_db_conf.Database_password + "@" + mongodb_full_address
+	if err != nil {
+		return nil, err
+	}
 
 	// Create a new client and connect to the server
-	mongo_client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(mongo_uri))
+	mongo_client, err := mongo.Connect(ctx, client_options)
+
 	if err != nil {
-		fast_logger.Fatalf("Cannot establish connection to MongoDB: %v", err)
+		return nil, fmt.Errorf("Cannot establish connection to MongoDB: %w", err)
 	}
 
-	defer func() {
-		if err = mongo_client.Disconnect(context.TODO()); err != nil {
-			fast_logger.Fatalf("Cannot disconnect from MongoDB: %v", err)
-		}
-	}()
-
 	// Ping the primary
-	if err := mongo_client.Ping(context.TODO(), readpref.Primary()); err != nil {
-		fast_logger.Fatalf("Cannot PING MongoDB: %v", err)
+	if err := mongo_client.Ping(ctx, readpref.Primary()); err != nil {
+		disconnect_from_mongodb(mongo_client)
+		return nil, fmt.Errorf("Cannot PING MongoDB: %w", err)
 	}
 
 	fast_logger.Printf("Successfully connected to MongoDB and executed PING query successfully")
 
-	// Read main configuration
-	main_collection := mongo_client.Database(global_db_conf.Db_name).Collection("configuration")
+	return mongo_client, nil
+}
 
-	err = main_collection.FindOne(context.TODO(), bson.D{}).Decode(&current_global_conf)
+// Disconnects from MongoDB
+// We use separate context because we disconnect even when context of command is cancelled
+func disconnect_from_mongodb(mongo_client *mongo.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := mongo_client.Disconnect(ctx); err != nil {
+		fast_logger.Fatalf("Cannot disconnect from MongoDB: %v", err)
+	}
+}
+
+// Reads main configuration of FastNetMon into current_global_conf
+func read_fastnetmon_configuration(ctx context.Context, storage storage_backend) error {
+	err := storage.read_fastnetmon_configuration(ctx, &current_global_conf)
 
 	if err != nil {
-		fast_logger.Fatalf("Could not retrieve main configuration from MongoDB: %v", err)
+		return err
 	}
 
-	fast_logger.Printf("Successfully read main configuration of FastNetMon from MongoDB")
+	fast_logger.Printf("Successfully read main configuration of FastNetMon from %s", storage.description())
 
-	// Read all hostgroups
-	fast_logger.Printf("Preparing to read all hostgroups")
+	apply_clickhouse_configuration()
 
-	hostgroups_collection := mongo_client.Database(global_db_conf.Db_name).Collection("hostgroups_configuration")
+	return nil
+}
 
-	var host_groups []Ban_settings_t
+// Connects to Clickhouse using configuration from FastNetMon and our overrides
+func connect_to_clickhouse(ctx context.Context) (*sql.DB, error) {
+	log.Printf("Trying to connect to Clickhouse on %s:%d", current_global_conf.Clickhouse_metrics_host, current_global_conf.Clickhouse_metrics_port)
+
+	// Database name comes from FastNetMon configuration and we use it in every query
+	err := validate_clickhouse_identifier("Clickhouse database", current_global_conf.Clickhouse_metrics_database)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// You can add debug option to clickhouse_settings for debugging
+	clickhouse_dsn, err := generate_clickhouse_dsn()
+
+	if err != nil {
+		return nil, err
+	}
 
-	cursor, err := hostgroups_collection.Find(context.TODO(), bson.D{})
+	clickhouse_client, err := sql.Open("clickhouse", clickhouse_dsn)
 
 	if err != nil {
-		fast_logger.Fatalf("Cannot load hostgroups from MongoDB: %v", err)
+		return nil, fmt.Errorf("Cannot connect to Clickhouse: %w", err)
+	}
+
+	if err := clickhouse_client.PingContext(ctx); err != nil {
+		clickhouse_client.Close()
+		return nil, fmt.Errorf("Cannot connect to Clickhouse: %w", err)
 	}
 
-	if err = cursor.All(context.Background(), &host_groups); err != nil {
-		fast_logger.Fatalf("Cannot retrieve hostgroups from MongoDB: %v", err)
+	fast_logger.Printf("Successfully connected to Clickhouse")
+
+	return clickhouse_client, nil
+}
+
+// Reads all hostgroups from storage and validates their networks
+// Problems with networks are added to report when it's not nil
+func read_hostgroups(ctx context.Context, storage storage_backend, report *RunReport) ([]Ban_settings_t, error) {
+	fast_logger.Printf("Preparing to read all hostgroups")
+
+	host_groups, err := storage.read_hostgroups(ctx)
+
+	if err != nil {
+		return nil, err
 	}
 
 	if len(host_groups) == 0 {
-		fast_logger.Fatalf("We do not have host groups for your query")
+		return nil, fmt.Errorf("We do not have host groups for your query")
 	}
 
 	fast_logger.Printf("Loaded %d hostgroups", len(host_groups))
@@ -285,136 +617,563 @@ func main() {
 		fast_logger.Printf("Hostgroup %s loaded with networks %v", host_group.Name, strings.Join(host_group.Networks, ","))
 	}
 
-	// fast_logger.Printf("%+v", current_global_conf)
+	host_groups = validate_hostgroups_networks(host_groups, report)
 
-	// fast_logger.Printf("Read custom database configuration: %+v", configuration)
+	if len(host_groups) == 0 {
+		return nil, fmt.Errorf("All hostgroups have invalid networks")
+	}
 
-	log.Printf("Trying to connect to Clickhouse on %s:%d", current_global_conf.Clickhouse_metrics_host, current_global_conf.Clickhouse_metrics_port)
+	// Every host is counted only in hostgroup where FastNetMon puts it
+	hostgroup_where_clauses = calculate_hostgroup_where_clauses(host_groups)
 
-	// You can add: ?debug=true for debugging
-	clickhouse_client, err := sql.Open("clickhouse", fmt.Sprintf("tcp://%s:%d", current_global_conf.Clickhouse_metrics_host, current_global_conf.Clickhouse_metrics_port))
+	for _, overlap := range find_network_overlaps(host_groups) {
+		fast_logger.Printf("Network %s of hostgroup %s overlaps with network %s of hostgroup %s, hosts go to %s",
+			overlap.Network, overlap.Hostgroup, overlap.OtherNetwork, overlap.OtherHostgroup, overlap.AssignedHostgroup)
+	}
 
-	if err != nil {
-		fast_logger.Fatalf("Cannot connect to Clickhouse: %v", err)
+	return host_groups, nil
+}
+
+// Recomputes baselines and top talkers according to schedule until we receive stop signal
+func run_daemon(stop_ctx context.Context, query_ctx context.Context, schedule *cron_schedule, storage storage_backend, clickhouse_client *sql.DB) {
+	if schedule != nil {
+		fast_logger.Printf("Started in daemon mode with schedule '%s'", configuration.DaemonSchedule)
+	} else {
+		fast_logger.Printf("Started in daemon mode with interval %d seconds", configuration.DaemonInterval)
 	}
 
-	if err := clickhouse_client.Ping(); err != nil {
-		fast_logger.Fatalf("Cannot connect to Clickhouse: %v", err)
+	for {
+		cycle_start := time.Now()
+
+		_, err := run_export_cycle(stop_ctx, query_ctx, storage, clickhouse_client, nil)
+
+		if err != nil {
+			fast_logger.Printf("Baseline export cycle failed: %v", err)
+		}
+
+		if stop_ctx.Err() != nil {
+			return
+		}
+
+		var next_run time.Time
+
+		if schedule != nil {
+			next_run = schedule.next(time.Now())
+		} else {
+			// We keep fixed rate and start next cycle immediately if this one took longer than interval
+			next_run = cycle_start.Add(time.Duration(configuration.DaemonInterval) * time.Second)
+		}
+
+		fast_logger.Printf("Next baseline export cycle scheduled at %s", next_run.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next_run))
+
+		select {
+		case <-stop_ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
 	}
+}
 
-	fast_logger.Printf("Successfully connected to Clickhouse")
+// Generates baselines and top talkers for all hostgroups once
+// Hostgroups are processed in parallel by configured number of workers
+// It stops taking new hostgroups when stop_ctx is cancelled and interrupts in-flight queries when query_ctx is cancelled
+// When dry_run is not nil we collect results into it instead of writing them to storage
+// Baseline history and per host baselines work only with MongoDB storage backend
+// Returned report has final status of run, we return it even when run failed
+func run_export_cycle(stop_ctx context.Context, query_ctx context.Context, storage storage_backend, clickhouse_client *sql.DB, dry_run *dry_run_report) (report *RunReport, cycle_err error) {
+	report = new_run_report(dry_run != nil)
 
-	for _, host_group := range host_groups {
-		// We do processing only for per_host hostgroups
-		if host_group.Calculation_method == "total" {
-			continue
+	// It's nil for storage backends other than MongoDB
+	mongo_client := storage.mongodb_client()
+
+	defer func() {
+		report.finish(cycle_err, stop_ctx.Err() != nil)
+
+		fast_logger.Printf("Baseline export finished with status %s", report.Status)
+
+		if report.DryRun {
+			return
+		}
+
+		// We store report even when run was interrupted and query_ctx is cancelled
+		store_ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		if err := store_run_report(store_ctx, storage, report); err != nil {
+			fast_logger.Printf("Cannot store run report: %v", err)
 		}
+	}()
+
+	if configuration.Workers < 1 {
+		return report, fmt.Errorf("workers must be positive, we have %d", configuration.Workers)
+	}
+
+	var host_groups []Ban_settings_t
+
+	err := retry_transient(query_ctx, "Reading of hostgroups", func() error {
+		var err error
+		host_groups, err = read_hostgroups(query_ctx, storage, report)
+		return err
+	})
+
+	if err != nil {
+		return report, err
+	}
 
-		fast_logger.Printf("Start baseline generation for %s", host_group.Name)
+	// All hostgroups use same time range to make results comparable
+	window := new_calculation_window(time.Now())
 
-		metrics, err := generate_baselines(host_group.Name, host_group.Networks, clickhouse_client, configuration.AggregationFunction)
+	statistics, err := configured_statistics()
+
+	if err != nil {
+		return report, err
+	}
+
+	if configuration.SeasonalBaseline {
+		err = validate_seasonal_configuration()
 
 		if err != nil {
-			// OK, we can tolerate some failures
-			fast_logger.Printf("Cannot generate baselines for %s with error %v", host_group.Name, err)
-			continue
+			return report, err
 		}
+	}
 
-		hostgroups_baseline_collection := mongo_client.Database(global_db_conf.Db_name).Collection("baseline_exporter_hostgroups_baseline")
+	err = validate_outlier_configuration()
 
-		filter := bson.D{{"name", host_group.Name}}
+	if err != nil {
+		return report, err
+	}
+
+	err = retry_transient(query_ctx, "Loading of attack exclusions", func() error {
+		return load_attack_exclusions(query_ctx, mongo_client, window)
+	})
+
+	if err != nil {
+		return report, err
+	}
+
+	if configuration.ThresholdRecommendations {
+		if problems := validate_threshold_rules(statistics); len(problems) > 0 {
+			return report, fmt.Errorf("Bad threshold rules: %s", strings.Join(problems, "; "))
+		}
+	}
 
-		true_bool := new(bool)
-		*true_bool = true
+	if mongo_client == nil && configuration.PerHostBaseline {
+		fast_logger.Printf("Per host baselines require MongoDB storage backend, we skip them")
+	}
 
-		_, err = hostgroups_baseline_collection.ReplaceOne(context.TODO(), filter, metrics, &options.ReplaceOptions{Upsert: true_bool})
+	if dry_run == nil && mongo_client != nil {
+		err = ensure_baseline_history_indexes(query_ctx, mongo_client)
 
 		if err != nil {
-			fast_logger.Printf("Cannot update baseline for %s in MongoDB: %v", host_group.Name, err)
-			continue
+			// We can still update latest baselines
+			fast_logger.Printf("Cannot prepare baseline history collection: %v", err)
 		}
 
-		fast_logger.Printf("Updated baseline in MongoDB for %s", host_group.Name)
+		if configuration.PerHostBaseline {
+			err = ensure_host_baselines_indexes(query_ctx, mongo_client)
 
-		if configuration.LogLevel == "debug" {
-			fast_logger.Printf("Metrics: %+v", metrics)
+			if err != nil {
+				fast_logger.Printf("Cannot prepare host baselines collection: %v", err)
+			}
 		}
 	}
 
-	// We have another loop to generate top talkers
+	if dry_run != nil {
+		// Workers finish hostgroups in any order but we print them in same order as we read them
+		for _, host_group := range host_groups {
+			dry_run.result_for(host_group.Name)
+		}
+	}
+
+	fast_logger.Printf("Processing %d hostgroups with %d workers", len(host_groups), configuration.Workers)
+
+	host_groups_queue := make(chan Ban_settings_t)
+	var workers sync.WaitGroup
+
+	for worker := int64(0); worker < configuration.Workers; worker++ {
+		workers.Add(1)
+
+		go func() {
+			defer workers.Done()
+
+			for host_group := range host_groups_queue {
+				process_hostgroup(query_ctx, storage, clickhouse_client, host_group, statistics, window, dry_run, report)
+			}
+		}()
+	}
+
+	stopped_at := ""
 
 	for _, host_group := range host_groups {
-		// We do processing only for per_host hostgroups
-		if host_group.Calculation_method == "total" {
-			continue
+		if stop_ctx.Err() != nil {
+			stopped_at = host_group.Name
+			break
 		}
 
-		fast_logger.Printf("Start top talkers generation for %s", host_group.Name)
+		// We wait for free worker here
+		select {
+		case host_groups_queue <- host_group:
+		case <-stop_ctx.Done():
+			stopped_at = host_group.Name
+		}
 
-		top_talkers, err := get_top_talkers_by_all_fields(host_group.Name, host_group.Networks, clickhouse_client, configuration.NumberOfTopTalkers)
+		if stopped_at != "" {
+			break
+		}
+	}
+
+	close(host_groups_queue)
+	workers.Wait()
+
+	if stopped_at != "" {
+		return report, fmt.Errorf("Stop requested before processing of %s", stopped_at)
+	}
+
+	return report, nil
+}
+
+// Returns context with deadline for single query
+func with_query_timeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if configuration.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, time.Duration(configuration.QueryTimeout)*time.Second)
+}
+
+// Generates and stores all results for hostgroup, we add failures to report and continue with other results
+func process_hostgroup(ctx context.Context, storage storage_backend, clickhouse_client *sql.DB, host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window, dry_run *dry_run_report, report *RunReport) {
+	if configuration.HostgroupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(configuration.HostgroupTimeout)*time.Second)
+		defer cancel()
+	}
+
+	hostgroup_started := time.Now()
+
+	export_baseline(ctx, storage, clickhouse_client, host_group, statistics, window, dry_run, report)
+
+	// Seasonal baselines are optional
+	if configuration.SeasonalBaseline {
+		export_seasonal_baseline(ctx, storage, clickhouse_client, host_group, statistics, window, dry_run, report)
+	}
+
+	// Per host baselines are optional too
+	if configuration.PerHostBaseline && storage.mongodb_client() != nil {
+		export_host_baselines(ctx, storage.mongodb_client(), clickhouse_client, host_group, statistics, window, dry_run, report)
+	}
+
+	// Top talkers are per host and we calculate them only for per_host hostgroups
+	if host_group.Calculation_method != "total" {
+		export_top_talkers(ctx, storage, clickhouse_client, host_group, window, dry_run, report)
+	}
+
+	fast_logger.Printf("Finished processing of %s in %s", host_group.Name, time.Since(hostgroup_started))
+}
+
+// Generates baseline and threshold recommendations for hostgroup and stores them
+func export_baseline(ctx context.Context, storage storage_backend, clickhouse_client *sql.DB, host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window, dry_run *dry_run_report, report *RunReport) {
+	fast_logger.Printf("Start baseline generation for %s", host_group.Name)
+
+	var metrics *BaselineStructure
+
+	err := retry_transient(ctx, "Baseline generation for "+host_group.Name, func() error {
+		var err error
+		metrics, err = generate_baselines(ctx, host_group, clickhouse_client, statistics, window)
+		return err
+	})
+
+	if err != nil {
+		// OK, we can tolerate some failures
+		report.add_error(host_group.Name, "Cannot generate baselines with error %v", err)
+		return
+	}
+
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("Metrics: %+v", metrics)
+	}
+
+	if configuration.ThresholdRecommendations {
+		export_recommendations(ctx, storage, metrics, dry_run, report)
+	}
+
+	if dry_run != nil {
+		err = dry_run.add_baseline(ctx, storage, metrics)
 
 		if err != nil {
-			fast_logger.Printf("Cannot get top talkers for %s with error %v", host_group.Name, err)
-			continue
+			report.add_error(host_group.Name, "Cannot compare baseline with %s: %v", storage.description(), err)
 		}
 
-		if configuration.LogLevel == "debug" {
-			fast_logger.Printf("Top talkers: %+v", top_talkers)
-		}
+		return
+	}
+
+	err = retry_transient(ctx, "Baseline update for "+host_group.Name, func() error {
+		return storage.write_document(ctx, hostgroups_baseline_collection_name, host_group.Name, metrics)
+	})
+
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot update baseline in %s: %v", storage.description(), err)
+		return
+	}
+
+	fast_logger.Printf("Updated baseline in %s for %s", storage.description(), host_group.Name)
+
+	if storage.mongodb_client() == nil {
+		return
+	}
+
+	err = retry_transient(ctx, "Baseline history update for "+host_group.Name, func() error {
+		return append_baseline_history(ctx, storage.mongodb_client(), metrics)
+	})
 
-		hostgroups_top_talkers_collection := mongo_client.Database(global_db_conf.Db_name).Collection("baseline_exporter_hostgroups_top_talkers")
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot add baseline to history: %v", err)
+	}
+}
 
-		filter := bson.D{{"name", host_group.Name}}
+// Generates seasonal baseline for hostgroup and stores it
+func export_seasonal_baseline(ctx context.Context, storage storage_backend, clickhouse_client *sql.DB, host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window, dry_run *dry_run_report, report *RunReport) {
+	fast_logger.Printf("Start seasonal baseline generation for %s", host_group.Name)
+
+	var seasonal_baseline *SeasonalBaselineStructure
+
+	err := retry_transient(ctx, "Seasonal baseline generation for "+host_group.Name, func() error {
+		var err error
+		seasonal_baseline, err = generate_seasonal_baselines(ctx, host_group, clickhouse_client, statistics, window)
+		return err
+	})
 
-		true_bool := new(bool)
-		*true_bool = true
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot generate seasonal baselines with error %v", err)
+		return
+	}
 
-		_, err = hostgroups_top_talkers_collection.ReplaceOne(context.TODO(), filter, top_talkers, &options.ReplaceOptions{Upsert: true_bool})
+	if dry_run != nil {
+		err = dry_run.add_seasonal_baseline(ctx, storage, seasonal_baseline)
 
 		if err != nil {
-			fast_logger.Printf("Cannot update top talkers for %s in MongoDB: %v", host_group.Name, err)
-			continue
+			report.add_error(host_group.Name, "Cannot compare seasonal baseline with %s: %v", storage.description(), err)
 		}
 
-		fast_logger.Printf("Updated top talkers in MongoDB for %s", host_group.Name)
+		return
+	}
+
+	err = retry_transient(ctx, "Seasonal baseline update for "+host_group.Name, func() error {
+		return storage.write_document(ctx, hostgroups_seasonal_baseline_collection_name, host_group.Name, seasonal_baseline)
+	})
+
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot update seasonal baseline in %s: %v", storage.description(), err)
+		return
 	}
+
+	fast_logger.Printf("Updated seasonal baseline in %s for %s", storage.description(), host_group.Name)
 }
 
-// Generates network WHERE clause to lookup IP in many IPv4 and IPv6 networks
-func generate_network_where_clause(networks_list []string) string {
+// Generates baselines for hosts of hostgroup and stores them in MongoDB
+func export_host_baselines(ctx context.Context, mongo_client *mongo.Client, clickhouse_client *sql.DB, host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window, dry_run *dry_run_report, report *RunReport) {
+	fast_logger.Printf("Start host baselines generation for %s", host_group.Name)
+
+	generation_started := time.Now()
+
+	var host_baselines []*HostBaselineStructure
+
+	err := retry_transient(ctx, "Host baselines generation for "+host_group.Name, func() error {
+		var err error
+		host_baselines, err = generate_host_baselines(ctx, host_group, clickhouse_client, statistics, window)
+		return err
+	})
+
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot generate host baselines with error %v", err)
+		return
+	}
+
+	if dry_run != nil {
+		dry_run.add_host_baselines(host_group.Name, host_baselines)
+		return
+	}
+
+	err = retry_transient(ctx, "Host baselines update for "+host_group.Name, func() error {
+		return write_host_baselines(ctx, mongo_client, host_group.Name, host_baselines, generation_started)
+	})
+
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot update host baselines in MongoDB: %v", err)
+		return
+	}
+
+	fast_logger.Printf("Updated baselines for %d hosts in MongoDB for %s", len(host_baselines), host_group.Name)
+}
+
+// Generates top talkers for hostgroup and stores them
+// We store top talkers even when some metrics failed, failed metrics are listed in errors field
+func export_top_talkers(ctx context.Context, storage storage_backend, clickhouse_client *sql.DB, host_group Ban_settings_t, window calculation_window, dry_run *dry_run_report, report *RunReport) {
+	fast_logger.Printf("Start top talkers generation for %s", host_group.Name)
+
+	top_talkers, err := get_top_talkers_by_all_fields(ctx, host_group.Name, host_group.Networks, clickhouse_client, configuration.NumberOfTopTalkers, window)
+
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot get top talkers with error %v", err)
+		return
+	}
+
+	for _, column := range traffic_metric_columns {
+		if metric_error, ok := top_talkers.Errors[column]; ok {
+			report.add_error(host_group.Name, "Cannot get top talkers by %s with error %s", column, metric_error)
+		}
+	}
 
-	all_sql_query_where_clauses := []string{}
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("Top talkers: %+v", top_talkers)
+	}
 
-	for _, network_string := range networks_list {
-		_, _, err := net.ParseCIDR(network_string)
+	if dry_run != nil {
+		err = dry_run.add_top_talkers(ctx, storage, top_talkers)
 
 		if err != nil {
-			fast_logger.Printf("Format error for prefix %s: %v", network_string, err)
-			continue
+			report.add_error(host_group.Name, "Cannot compare top talkers with %s: %v", storage.description(), err)
 		}
 
-		query_in_clause := fmt.Sprintf("isIPAddressInRange(host, '%s')", network_string)
+		return
+	}
+
+	err = retry_transient(ctx, "Top talkers update for "+host_group.Name, func() error {
+		return storage.write_document(ctx, hostgroups_top_talkers_collection_name, host_group.Name, top_talkers)
+	})
 
-		all_sql_query_where_clauses = append(all_sql_query_where_clauses, query_in_clause)
+	if err != nil {
+		report.add_error(host_group.Name, "Cannot update top talkers in %s: %v", storage.description(), err)
+		return
 	}
 
-	// We handle it that way for global group which has no networks at all
-	merged_where_clause_by_networks := "1 = 1"
+	fast_logger.Printf("Updated top talkers in %s for %s", storage.description(), host_group.Name)
+}
 
-	if len(all_sql_query_where_clauses) > 0 {
-		merged_where_clause_by_networks = strings.Join(all_sql_query_where_clauses, " OR ")
+// Generates network WHERE clause to lookup IP in many IPv4 and IPv6 networks
+// Networks are merged into ranges of addresses and we compare host address with them
+func generate_network_where_clause(networks_list []string) built_query {
+	// We handle it that way for global group which has no networks at all
+	if len(networks_list) == 0 {
+		return query_text("1 = 1")
 	}
 
-	return merged_where_clause_by_networks
+	// When all networks are invalid we get no ranges and must not select traffic of all hosts
+	return generate_address_ranges_condition(parse_network_ranges(networks_list))
 }
 
 // Returns WHERE section to filter by date and date time
-func generate_date_filter() string {
-	return fmt.Sprintf("metricDate >= toDate(now() - %d) and (metricDateTime >= now() - %d)", configuration.CalculationPeriod, configuration.CalculationPeriod)
+// We subtract maintenance windows of hostgroup from calculation window
+func generate_date_filter(window calculation_window, hostgroup_name string, have_hosts bool) built_query {
+	return format_query("%s and (%s)", generate_window_filter(window), generate_maintenance_where_clause(hostgroup_name, window, have_hosts))
+}
+
+// Returns WHERE section which selects whole calculation window
+func generate_window_filter(window calculation_window) built_query {
+	return query_text(fmt.Sprintf("metricDate >= toDate(%d) and (metricDateTime >= toDateTime(%d)) and (metricDateTime <= toDateTime(%d))", window.start.Unix(), window.start.Unix(), window.end.Unix()))
+}
+
+// Table and filter which we use to select traffic samples for hostgroup
+type metrics_source struct {
+	// Table or subquery for FROM section
+	table built_query
+
+	where_clause built_query
+
+	// Expression which returns number of distinct hosts
+	distinct_hosts string
+}
+
+// Returns source of traffic samples for every host in hostgroup
+func generate_host_metrics_source(host_group Ban_settings_t, window calculation_window) metrics_source {
+	return generate_host_metrics_source_with_exclusions(host_group, window, true)
+}
+
+// Returns source of traffic samples for every host in hostgroup
+// When apply_exclusions is false we keep attack periods and maintenance windows
+func generate_host_metrics_source_with_exclusions(host_group Ban_settings_t, window calculation_window, apply_exclusions bool) metrics_source {
+	conditions := []built_query{generate_window_filter(window), generate_hostgroup_where_clause(host_group.Name, host_group.Networks)}
+
+	if apply_exclusions {
+		conditions = []built_query{generate_date_filter(window, host_group.Name, true), generate_hostgroup_where_clause(host_group.Name, host_group.Networks), generate_exclusions_where_clause(true)}
+	}
+
+	return metrics_source{
+		table:          query_text(clickhouse_table_name(current_global_conf.Clickhouse_metrics_database, "host_metrics")),
+		where_clause:   join_conditions(conditions),
+		distinct_hosts: "uniqExact(host)",
+	}
+}
+
+// Returns source of traffic samples for hostgroup
+// For total hostgroups every sample is sum of traffic of all hosts in hostgroup for one moment
+func generate_metrics_source(host_group Ban_settings_t, window calculation_window) metrics_source {
+	return generate_metrics_source_with_exclusions(host_group, window, true)
+}
+
+// Returns source of traffic samples for hostgroup
+// When apply_exclusions is false we keep attack periods and maintenance windows
+func generate_metrics_source_with_exclusions(host_group Ban_settings_t, window calculation_window, apply_exclusions bool) metrics_source {
+	host_source := generate_host_metrics_source_with_exclusions(host_group, window, apply_exclusions)
+
+	if host_group.Calculation_method != "total" {
+		return host_source
+	}
+
+	// Some installations have table with traffic of hostgroups and we can avoid summing on the fly
+	// We have no information about hosts in this case
+	if configuration.HostgroupMetricsTable != "" {
+		hostgroup_condition := format_query("hostgroup = %s", bind_query_parameter(host_group.Name))
+		conditions := []built_query{generate_window_filter(window), hostgroup_condition}
+
+		if apply_exclusions {
+			conditions = []built_query{generate_date_filter(window, host_group.Name, false), hostgroup_condition, generate_exclusions_where_clause(false)}
+		}
+
+		return metrics_source{
+			table:          query_text(clickhouse_table_name(current_global_conf.Clickhouse_metrics_database, configuration.HostgroupMetricsTable)),
+			where_clause:   join_conditions(conditions),
+			distinct_hosts: "toUInt64(0)",
+		}
+	}
+
+	summed_fields := processMap(traffic_metric_columns, func(value string) string {
+		return fmt.Sprintf("%s AS %s", aggregate_function_call("sum", "", nil, value), value)
+	})
+
+	summed_query := new_select_query("metricDateTime", aggregate_function_call("uniqExact", "", nil, "host")+" AS active_hosts").columns(summed_fields...).
+		from(host_source.table).where(host_source.where_clause).group("metricDateTime")
+
+	return metrics_source{
+		table:        format_query("(%s)", summed_query.build()),
+		where_clause: query_text("1 = 1"),
+		// It's maximum number of hosts which had traffic at same time
+		distinct_hosts: "max(active_hosts)",
+	}
+}
+
+// Fills metadata with information about calculation
+func fill_calculation_metadata(metadata *CalculationMetadata, hostgroup_name string, networks_list []string, window calculation_window, aggregation_function string) {
+	metadata.ComputedAt = time.Now()
+	metadata.WindowStart = window.start
+	metadata.WindowEnd = window.end
+	metadata.AggregationFunction = aggregation_function
+	metadata.ExporterVersion = exporter_version
+	metadata.Networks = networks_list
+	metadata.ExcludedRanges = int64(len(attack_exclusions))
+	metadata.MaintenanceWindows = maintenance_window_names(hostgroup_name, window)
+
+	// We keep empty list instead of null for global hostgroup
+	if metadata.Networks == nil {
+		metadata.Networks = []string{}
+	}
 }
 
-// Creates number of top talkers by using all possible metrics
-func get_top_talkers_by_all_fields(hostgroup_name string, networks_list []string, clickhouse_client *sql.DB, top_talkers_number uint64) (*TopTalkersStructure, error) {
+// Get top talkers for all traffic types in single scan of host_metrics
+func get_top_talkers_by_all_fields(ctx context.Context, hostgroup_name string, networks_list []string, clickhouse_client *sql.DB, top_talkers_number uint64, window calculation_window) (*TopTalkersStructure, error) {
 	all_top_talkers := TopTalkersStructure{}
 
 	all_top_talkers.Name = hostgroup_name
@@ -451,153 +1210,256 @@ func get_top_talkers_by_all_fields(hostgroup_name string, networks_list []string
 		"tcp_syn_bits_outgoing":    &all_top_talkers.Outgoing.Tcp_syn_bits,
 	}
 
-	for metric_type, target_field := range fields_for_processing {
-		top_talkers, err := get_top_talkers_by_field(hostgroup_name, networks_list, clickhouse_client, metric_type, top_talkers_number)
+	err := retry_transient(ctx, "Top talkers query for "+hostgroup_name, func() error {
+		return query_top_talkers(ctx, clickhouse_client, hostgroup_name, networks_list, top_talkers_number, window, traffic_metric_columns, &all_top_talkers.Metadata, fields_for_processing)
+	})
 
-		if err != nil {
-			return nil, fmt.Errorf("Cannot generate top talkers by field %s with error %v", metric_type, err)
+	// When single query for all metrics fails we query metrics one by one and keep results for metrics which worked
+	if err != nil && ctx.Err() == nil {
+		fast_logger.Printf("Top talkers query for all metrics failed for %s, querying metrics separately: %v", hostgroup_name, err)
+
+		all_top_talkers.Errors = map[string]string{}
+
+		for _, column := range traffic_metric_columns {
+			column_err := retry_transient(ctx, "Top talkers query by "+column+" for "+hostgroup_name, func() error {
+				return query_top_talkers(ctx, clickhouse_client, hostgroup_name, networks_list, top_talkers_number, window, []string{column}, &all_top_talkers.Metadata, fields_for_processing)
+			})
+
+			if column_err != nil {
+				all_top_talkers.Errors[column] = column_err.Error()
+				*fields_for_processing[column] = []TopTalker{}
+			}
 		}
 
-		*target_field = top_talkers
+		if len(all_top_talkers.Errors) < len(traffic_metric_columns) {
+			err = nil
+		}
+	}
 
-		// fast_logger.Printf("Top talkers by %s are %+v", metric_type, top_talkers)
+	if err != nil {
+		return nil, err
 	}
 
-	// fast_logger.Printf("Top talkers: %+v", all_top_talkers)
+	// We use max to aggregate top talkers
+	fill_calculation_metadata(&all_top_talkers.Metadata, hostgroup_name, networks_list, window, "max")
+
 	return &all_top_talkers, nil
 }
 
-// Get top talkers ordered by specific type of traffic passed in field_for_query
-func get_top_talkers_by_field(hostgroup_name string, networks_list []string, clickhouse_client *sql.DB, field_for_query string, top_talkers_number uint64) ([]TopTalker, error) {
-	merged_where_clause_by_networks := generate_network_where_clause(networks_list)
+// Executes top talkers query for specified columns and stores top talkers by fields_for_processing
+func query_top_talkers(ctx context.Context, clickhouse_client *sql.DB, hostgroup_name string, networks_list []string, top_talkers_number uint64, window calculation_window, columns []string, metadata *CalculationMetadata, fields_for_processing map[string]*[]TopTalker) error {
+	query := generate_top_talkers_query(hostgroup_name, networks_list, top_talkers_number, window, columns)
 
-	// We use max to aggregate top talkers
-	aggregation_function := "max"
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("SQL Query: %s\n", query.sql)
+	}
 
-	query := fmt.Sprintf("SELECT host, %s(toInt64(%s)) as max_value FROM %s.%s WHERE (%s) AND (%s) GROUP by host ORDER BY max_value DESC LIMIT %d", aggregation_function, field_for_query, current_global_conf.Clickhouse_metrics_database, "host_metrics", generate_date_filter(), merged_where_clause_by_networks, top_talkers_number)
+	// Hosts and values of top talkers for every column in order of columns
+	top_talkers_hosts := make([][]string, len(columns))
+	top_talkers_values := make([][]int64, len(columns))
 
-	if configuration.LogLevel == "debug" {
-		fast_logger.Printf("SQL Query: %s\n", query)
+	destinations := []interface{}{&metadata.SampleCount, &metadata.DistinctHosts}
+
+	for index := range columns {
+		destinations = append(destinations, &top_talkers_hosts[index], &top_talkers_values[index])
 	}
 
-	rows, err := clickhouse_client.Query(query)
+	// Query ID allows to find read_rows and read_bytes of this query in system.query_log
+	query_ctx, cancel := with_query_timeout(ctx)
+	defer cancel()
+
+	query_id := fmt.Sprintf("baseline_exporter_top_talkers_%s_%d", hostgroup_name, time.Now().UnixNano())
+	query_started := time.Now()
+
+	err := clickhouse_client.QueryRowContext(clickhouse.WithQueryID(query_ctx, query_id), query.sql, query.arguments()...).Scan(destinations...)
 
 	if err != nil {
-		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w\n", query, err)
+		return fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w\n", query.sql, err)
 	}
 
-	top_talkers := []TopTalker{}
+	fast_logger.Printf("Top talkers query for %s took %s, query ID %s", hostgroup_name, time.Since(query_started), query_id)
 
-	for rows.Next() {
-		var top_talker TopTalker
-
-		err := rows.Scan(&top_talker.Host, &top_talker.Value)
+	for index, column := range columns {
+		top_talkers := []TopTalker{}
 
-		if err != nil {
-			return nil, errors.Errorf("Cannot read row: %v", err)
+		for host_index, host := range top_talkers_hosts[index] {
+			top_talkers = append(top_talkers, TopTalker{Host: host, Value: top_talkers_values[index][host_index]})
 		}
 
-		top_talkers = append(top_talkers, top_talker)
+		*fields_for_processing[column] = top_talkers
 	}
 
-	return top_talkers, nil
+	return nil
 }
 
-// Generates baseline for list of networks according to Clickhosue history data
-func generate_baselines(hostgroup_name string, networks_list []string, clickhouse_client *sql.DB, aggregation_function string) (*BaselineStructure, error) {
-	merged_where_clause_by_networks := generate_network_where_clause(networks_list)
+// Generates SQL query which returns number of samples, number of distinct hosts and top talkers for specified traffic types
+// We aggregate traffic per host once, turn it into row per host and column and keep top_talkers_number rows for every column with LIMIT BY
+// Rows with empty column name carry number of samples of host, we keep all of them to count samples and hosts
+// For every column query returns array of hosts and array of values
+func generate_top_talkers_query(hostgroup_name string, networks_list []string, top_talkers_number uint64, window calculation_window, columns []string) built_query {
+	merged_where_clause_by_networks := generate_hostgroup_where_clause(hostgroup_name, networks_list)
+
+	host_aggregates := []string{"toString(host) AS host_name", "COUNT(*) AS host_samples"}
+	host_metrics := []string{"('', toInt64(host_samples))"}
+	top_talkers := []string{aggregate_function_call("sum", "If", nil, "metric_value", "metric_name = ''") + " AS samples", aggregate_function_call("count", "If", nil, "metric_name = ''") + " AS hosts"}
+	outputs := []string{"samples", "hosts"}
+
+	for _, column := range columns {
+		// We use max to aggregate top talkers
+		host_aggregates = append(host_aggregates, fmt.Sprintf("%s AS max_%s", aggregate_function_call("max", "", nil, fmt.Sprintf("toInt64(%s)", column)), column))
+		host_metrics = append(host_metrics, fmt.Sprintf("(%s, max_%s)", quote_clickhouse_string(column), column))
+
+		// LIMIT BY leaves only top_talkers_number rows for column and we sort this short list
+		top_talkers = append(top_talkers, fmt.Sprintf("arrayReverseSort(talker -> talker.2, %s) AS top_%s",
+			aggregate_function_call("groupArray", "If", nil, "(host_name, metric_value)", "metric_name = "+quote_clickhouse_string(column)), column))
+		outputs = append(outputs, fmt.Sprintf("arrayMap(talker -> talker.1, top_%s)", column), fmt.Sprintf("arrayMap(talker -> talker.2, top_%s)", column))
+	}
 
-	fields_for_processing := []string{
-		"packets_incoming",
-		"packets_outgoing",
-		"bits_incoming",
-		"bits_outgoing",
-		"flows_incoming",
-		"flows_outgoing",
+	per_host_query := new_select_query(host_aggregates...).
+		from_table(current_global_conf.Clickhouse_metrics_database, "host_metrics").
+		where(generate_date_filter(window, hostgroup_name, true), merged_where_clause_by_networks).
+		group("host")
 
-		// Per protocol counters
-		"tcp_packets_incoming",
-		"tcp_packets_outgoing",
-		"udp_packets_incoming",
-		"udp_packets_outgoing",
-		"icmp_packets_incoming",
-		"icmp_packets_outgoing",
-		"fragmented_packets_incoming",
-		"fragmented_packets_outgoing",
-		"tcp_syn_packets_incoming",
-		"tcp_syn_packets_outgoing",
-		"tcp_bits_incoming",
-		"tcp_bits_outgoing",
-		"udp_bits_incoming",
-		"udp_bits_outgoing",
-		"icmp_bits_incoming",
-		"icmp_bits_outgoing",
-		"fragmented_bits_incoming",
-		"fragmented_bits_outgoing",
-		"tcp_syn_bits_incoming",
-		"tcp_syn_bits_outgoing",
-	}
-
-	fields_for_processing = processMap(fields_for_processing, func(value string) string {
-		return fmt.Sprintf("toInt64(%s(%s))", aggregation_function, value)
+	ranked_query := new_select_query("metric.1 AS metric_name", "host_name", "metric.2 AS metric_value").
+		from_subquery(per_host_query).
+		array_join(fmt.Sprintf("[%s] AS metric", strings.Join(host_metrics, ", "))).
+		order("metric_name", "metric_value DESC").
+		limit_rows_by(top_talkers_number, "metric_name", "if(metric_name = '', host_name, '')")
+
+	return new_select_query(outputs...).from_subquery(new_select_query(top_talkers...).from_subquery(ranked_query)).build()
+}
+
+// All traffic metrics from host_metrics table which we use for baselines and top talkers
+var traffic_metric_columns = []string{
+	"packets_incoming",
+	"packets_outgoing",
+	"bits_incoming",
+	"bits_outgoing",
+	"flows_incoming",
+	"flows_outgoing",
+
+	// Per protocol counters
+	"tcp_packets_incoming",
+	"tcp_packets_outgoing",
+	"udp_packets_incoming",
+	"udp_packets_outgoing",
+	"icmp_packets_incoming",
+	"icmp_packets_outgoing",
+	"fragmented_packets_incoming",
+	"fragmented_packets_outgoing",
+	"tcp_syn_packets_incoming",
+	"tcp_syn_packets_outgoing",
+	"tcp_bits_incoming",
+	"tcp_bits_outgoing",
+	"udp_bits_incoming",
+	"udp_bits_outgoing",
+	"icmp_bits_incoming",
+	"icmp_bits_outgoing",
+	"fragmented_bits_incoming",
+	"fragmented_bits_outgoing",
+	"tcp_syn_bits_incoming",
+	"tcp_syn_bits_outgoing",
+}
+
+// Generates SQL query which calculates baseline for list of networks
+// outlier_conditions can be nil when we do not reject outliers
+func generate_baseline_query(host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window, outlier_conditions map[string]string) built_query {
+	source := generate_metrics_source(host_group, window)
+
+	fields_for_processing := processMap(traffic_metric_columns, func(value string) string {
+		return strings.Join(generate_statistics_expressions(value, statistics, outlier_conditions[value]), ",")
 	})
 
-	query := fmt.Sprintf("SELECT COUNT(*), %s FROM %s.%s WHERE (%s) AND (%s)", strings.Join(fields_for_processing, ","), current_global_conf.Clickhouse_metrics_database, "host_metrics", generate_date_filter(), merged_where_clause_by_networks)
+	return new_select_query("COUNT(*)", source.distinct_hosts).columns(fields_for_processing...).from(source.table).where(source.where_clause).build()
+}
+
+// Returns scan destinations for all metric columns in order of traffic_metric_columns
+// apply must be called after scan to store values into baseline
+func baseline_scan_destinations(baseline *BaselineStructure, statistics []*traffic_statistic) ([]interface{}, func()) {
+	destinations := []interface{}{}
+	apply_functions := []func(){}
+
+	for _, column := range traffic_metric_columns {
+		column_destinations, apply := statistics_scan_destinations(baseline.value_by_column(column), statistics)
+
+		destinations = append(destinations, column_destinations...)
+		apply_functions = append(apply_functions, apply)
+	}
+
+	return destinations, func() {
+		for _, apply := range apply_functions {
+			apply()
+		}
+	}
+}
+
+// Generates baseline for list of networks according to Clickhosue history data
+func generate_baselines(ctx context.Context, host_group Ban_settings_t, clickhouse_client *sql.DB, statistics []*traffic_statistic, window calculation_window) (*BaselineStructure, error) {
+	hostgroup_name := host_group.Name
+
+	outlier_conditions, err := calculate_outlier_conditions(ctx, host_group, clickhouse_client, window)
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := generate_baseline_query(host_group, statistics, window, outlier_conditions)
 
 	if configuration.LogLevel == "debug" {
-		fast_logger.Printf("SQL Query: %s\n", query)
+		fast_logger.Printf("SQL Query: %s\n", query.sql)
 	}
 
-	rows, err := clickhouse_client.Query(query)
+	query_ctx, cancel := with_query_timeout(ctx)
+	defer cancel()
+
+	rows, err := clickhouse_client.QueryContext(query_ctx, query.sql, query.arguments()...)
 
 	if err != nil {
-		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w\n", query, err)
+		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w\n", query.sql, err)
 	}
 
+	defer rows.Close()
+
 	fast_logger.Printf("Retrieve traffic metrics for hostgroup %s", hostgroup_name)
 
+	var metrics_row *BaselineStructure
+
+	// Query returns single row and we read all rows to get stream errors from rows.Err
 	for rows.Next() {
-		metrics_row := &BaselineStructure{}
+		if metrics_row != nil {
+			continue
+		}
+
+		metrics_row = &BaselineStructure{}
 		metrics_row.Name = hostgroup_name
 
-		var hosts_with_traffic int64
-
-		err := rows.Scan(&hosts_with_traffic,
-			&metrics_row.Incoming.Packets.Quantile95,
-			&metrics_row.Outgoing.Packets.Quantile95,
-			&metrics_row.Incoming.Bits.Quantile95,
-			&metrics_row.Outgoing.Bits.Quantile95,
-			&metrics_row.Incoming.Flows.Quantile95,
-			&metrics_row.Outgoing.Flows.Quantile95,
-			&metrics_row.Incoming.Tcp_packets.Quantile95,
-			&metrics_row.Outgoing.Tcp_packets.Quantile95,
-			&metrics_row.Incoming.Udp_packets.Quantile95,
-			&metrics_row.Outgoing.Udp_packets.Quantile95,
-			&metrics_row.Incoming.Icmp_packets.Quantile95,
-			&metrics_row.Outgoing.Icmp_packets.Quantile95,
-			&metrics_row.Incoming.Fragmented_packets.Quantile95,
-			&metrics_row.Outgoing.Fragmented_packets.Quantile95,
-			&metrics_row.Incoming.Tcp_syn_packets.Quantile95,
-			&metrics_row.Outgoing.Tcp_syn_packets.Quantile95,
-			&metrics_row.Incoming.Tcp_bits.Quantile95,
-			&metrics_row.Outgoing.Tcp_bits.Quantile95,
-			&metrics_row.Incoming.Udp_bits.Quantile95,
-			&metrics_row.Outgoing.Udp_bits.Quantile95,
-			&metrics_row.Incoming.Icmp_bits.Quantile95,
-			&metrics_row.Outgoing.Icmp_bits.Quantile95,
-			&metrics_row.Incoming.Fragmented_bits.Quantile95,
-			&metrics_row.Outgoing.Fragmented_bits.Quantile95,
-			&metrics_row.Incoming.Tcp_syn_bits.Quantile95,
-			&metrics_row.Outgoing.Tcp_syn_bits.Quantile95)
+		destinations := []interface{}{&metrics_row.Metadata.SampleCount, &metrics_row.Metadata.DistinctHosts}
+
+		column_destinations, apply := baseline_scan_destinations(metrics_row, statistics)
+
+		err := rows.Scan(append(destinations, column_destinations...)...)
 
 		if err != nil {
 			return nil, errors.Errorf("Cannot read row: %v", err)
 		}
 
-		return metrics_row, nil
+		apply()
+
+		fill_calculation_metadata(&metrics_row.Metadata, host_group.Name, host_group.Networks, window, statistics_aggregation_function(statistics))
+		metrics_row.Metadata.CalculationMethod = host_group.Calculation_method
+		metrics_row.Metadata.Statistics = statistic_names(statistics)
+		metrics_row.Metadata.OutlierRejection = configuration.OutlierRejection
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read baseline from Clickhouse: %w", err)
+	}
+
+	if metrics_row == nil {
+		return nil, fmt.Errorf("There are no data in CLickhouse")
 	}
 
-	return nil, fmt.Errorf("There are no data in CLickhouse")
+	return metrics_row, nil
 }
 
 // Applies function to all elements
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// Planned event which distorts traffic: migration, load test, sporting event and so on
+type MaintenanceWindow struct {
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Hostgroups affected by event, empty list means all hostgroups
+	Hostgroups []string `json:"hostgroups"`
+
+	// Networks affected by event, empty list means all hosts
+	Networks []string `json:"networks"`
+}
+
+// Windows from configuration and maintenance file
+var maintenance_calendar []MaintenanceWindow
+
+// Checks maintenance window from configuration
+func validate_maintenance_window(maintenance_window MaintenanceWindow) error {
+	if !maintenance_window.End.After(maintenance_window.Start) {
+		return fmt.Errorf("maintenance window %s must end after start", maintenance_window.Name)
+	}
+
+	for _, network := range maintenance_window.Networks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			return fmt.Errorf("maintenance window %s has bad network %s: %v", maintenance_window.Name, network, err)
+		}
+	}
+
+	return nil
+}
+
+// Loads maintenance windows from configuration and maintenance_file into maintenance_calendar
+func load_maintenance_calendar() error {
+	maintenance_windows := append([]MaintenanceWindow{}, configuration.MaintenanceWindows...)
+
+	if configuration.MaintenanceFile != "" {
+		file_as_array, err := ioutil.ReadFile(configuration.MaintenanceFile)
+
+		if err != nil {
+			return fmt.Errorf("Cannot read maintenance file %s: %w", configuration.MaintenanceFile, err)
+		}
+
+		file_windows := []MaintenanceWindow{}
+
+		err = json.Unmarshal(file_as_array, &file_windows)
+
+		if err != nil {
+			return fmt.Errorf("Cannot decode maintenance file %s: %w", configuration.MaintenanceFile, err)
+		}
+
+		maintenance_windows = append(maintenance_windows, file_windows...)
+	}
+
+	for _, maintenance_window := range maintenance_windows {
+		if err := validate_maintenance_window(maintenance_window); err != nil {
+			return err
+		}
+	}
+
+	maintenance_calendar = maintenance_windows
+
+	return nil
+}
+
+// Returns maintenance windows which overlap with calculation window and affect hostgroup
+func maintenance_windows_for_hostgroup(hostgroup_name string, window calculation_window) []MaintenanceWindow {
+	maintenance_windows := []MaintenanceWindow{}
+
+	for _, maintenance_window := range maintenance_calendar {
+		if maintenance_window.Start.After(window.end) || maintenance_window.End.Before(window.start) {
+			continue
+		}
+
+		affected := len(maintenance_window.Hostgroups) == 0
+
+		for _, name := range maintenance_window.Hostgroups {
+			if name == hostgroup_name {
+				affected = true
+			}
+		}
+
+		if affected {
+			maintenance_windows = append(maintenance_windows, maintenance_window)
+		}
+	}
+
+	return maintenance_windows
+}
+
+// Generates WHERE clause which removes maintenance windows of hostgroup
+// When we have no information about hosts we can remove only windows for all hosts
+func generate_maintenance_where_clause(hostgroup_name string, window calculation_window, have_hosts bool) built_query {
+	conditions := []built_query{}
+
+	for _, maintenance_window := range maintenance_windows_for_hostgroup(hostgroup_name, window) {
+		time_condition := fmt.Sprintf("metricDateTime >= toDateTime(%d) AND metricDateTime <= toDateTime(%d)", maintenance_window.Start.Unix(), maintenance_window.End.Unix())
+
+		if len(maintenance_window.Networks) == 0 {
+			conditions = append(conditions, query_text(fmt.Sprintf("NOT (%s)", time_condition)))
+			continue
+		}
+
+		if !have_hosts {
+			continue
+		}
+
+		conditions = append(conditions, format_query("NOT (%s AND (%s))", query_text(time_condition), generate_network_where_clause(maintenance_window.Networks)))
+	}
+
+	if len(conditions) == 0 {
+		return query_text("1 = 1")
+	}
+
+	return join_queries(conditions, " AND ")
+}
+
+// Returns names of maintenance windows which we removed from calculation window of hostgroup
+func maintenance_window_names(hostgroup_name string, window calculation_window) []string {
+	names := []string{}
+
+	for _, maintenance_window := range maintenance_windows_for_hostgroup(hostgroup_name, window) {
+		names = append(names, maintenance_window.Name)
+	}
+
+	return names
+}
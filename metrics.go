@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+)
+
+// Splits host_metrics column like tcp_packets_incoming into metric and direction
+func split_metric_column(column string) (string, string) {
+	if strings.HasSuffix(column, "_incoming") {
+		return strings.TrimSuffix(column, "_incoming"), "incoming"
+	}
+
+	return strings.TrimSuffix(column, "_outgoing"), "outgoing"
+}
+
+// Returns value for metric like tcp_packets or nil for unknown metric
+func (traffic_baseline *TrafficBaseline) value_by_metric(metric string) *TrafficValue {
+	switch metric {
+	case "packets":
+		return &traffic_baseline.Packets
+	case "bits":
+		return &traffic_baseline.Bits
+	case "flows":
+		return &traffic_baseline.Flows
+	case "tcp_packets":
+		return &traffic_baseline.Tcp_packets
+	case "udp_packets":
+		return &traffic_baseline.Udp_packets
+	case "icmp_packets":
+		return &traffic_baseline.Icmp_packets
+	case "fragmented_packets":
+		return &traffic_baseline.Fragmented_packets
+	case "tcp_syn_packets":
+		return &traffic_baseline.Tcp_syn_packets
+	case "tcp_bits":
+		return &traffic_baseline.Tcp_bits
+	case "udp_bits":
+		return &traffic_baseline.Udp_bits
+	case "icmp_bits":
+		return &traffic_baseline.Icmp_bits
+	case "fragmented_bits":
+		return &traffic_baseline.Fragmented_bits
+	case "tcp_syn_bits":
+		return &traffic_baseline.Tcp_syn_bits
+	}
+
+	return nil
+}
+
+// Returns value for host_metrics column like tcp_packets_incoming
+func (baseline *BaselineStructure) value_by_column(column string) *TrafficValue {
+	metric, direction := split_metric_column(column)
+
+	if direction == "incoming" {
+		return baseline.Incoming.value_by_metric(metric)
+	}
+
+	return baseline.Outgoing.value_by_metric(metric)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// Environment variable with complete MongoDB connection URI, it overrides all other MongoDB settings
+const mongodb_uri_environment_variable = "BASELINE_EXPORTER_MONGODB_URI"
+
+// Path to password which FastNetMon installer generates for MongoDB
+const mongodb_password_path = "/etc/fastnetmon/keychain/.mongo_fastnetmon_password"
+
+// Read concern levels supported by MongoDB
+var mongodb_read_concern_levels = []string{"local", "available", "majority", "linearizable", "snapshot"}
+
+// Returns complete connection URI from environment or configuration, empty string when we build connection from separate options
+func mongodb_connection_uri() string {
+	mongo_uri := os.Getenv(mongodb_uri_environment_variable)
+
+	if mongo_uri != "" {
+		return mongo_uri
+	}
+
+	return global_db_conf.Mongodb_uri
+}
+
+// Returns list of MongoDB servers in host:port format
+func mongodb_hosts() []string {
+	if len(global_db_conf.Mongodb_hosts) > 0 {
+		return global_db_conf.Mongodb_hosts
+	}
+
+	mongodb_address := global_db_conf.Database_address
+
+	// Add brackets for IPv6 addresses
+	if strings.Contains(mongodb_address, ":") {
+		mongodb_address = "[" + mongodb_address + "]"
+	}
+
+	return []string{fmt.Sprintf("%s:%d", mongodb_address, global_db_conf.Mongodb_port)}
+}
+
+// Creates TLS configuration for MongoDB connection from CA and client certificate files
+func mongodb_tls_config() (*tls.Config, error) {
+	tls_config := &tls.Config{InsecureSkipVerify: global_db_conf.Mongodb_tls_insecure}
+
+	if global_db_conf.Mongodb_tls_ca_file != "" {
+		ca_certificate, err := ioutil.ReadFile(global_db_conf.Mongodb_tls_ca_file)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read MongoDB CA file %s: %w", global_db_conf.Mongodb_tls_ca_file, err)
+		}
+
+		tls_config.RootCAs = x509.NewCertPool()
+
+		if !tls_config.RootCAs.AppendCertsFromPEM(ca_certificate) {
+			return nil, fmt.Errorf("MongoDB CA file %s has no PEM certificates", global_db_conf.Mongodb_tls_ca_file)
+		}
+	}
+
+	if global_db_conf.Mongodb_tls_cert_file != "" {
+		// Key can be stored in same file with certificate
+		key_file := global_db_conf.Mongodb_tls_key_file
+
+		if key_file == "" {
+			key_file = global_db_conf.Mongodb_tls_cert_file
+		}
+
+		certificate, err := tls.LoadX509KeyPair(global_db_conf.Mongodb_tls_cert_file, key_file)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load MongoDB client certificate %s: %w", global_db_conf.Mongodb_tls_cert_file, err)
+		}
+
+		tls_config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tls_config, nil
+}
+
+// Creates write concern from configuration value: majority or number of nodes
+func mongodb_write_concern(value string) (*writeconcern.WriteConcern, error) {
+	if value == "majority" {
+		return writeconcern.New(writeconcern.WMajority()), nil
+	}
+
+	nodes, err := strconv.Atoi(value)
+
+	if err != nil || nodes < 0 {
+		return nil, fmt.Errorf("mongodb_write_concern must be majority or number of nodes, we have %s", value)
+	}
+
+	return writeconcern.New(writeconcern.W(nodes)), nil
+}
+
+// Checks that we know read concern level
+func validate_mongodb_read_concern(level string) error {
+	for _, known_level := range mongodb_read_concern_levels {
+		if level == known_level {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("mongodb_read_concern must be one of %s, we have %s", strings.Join(mongodb_read_concern_levels, ", "), level)
+}
+
+// Builds options for MongoDB client from database configuration
+// When we have complete URI we use it as is and ignore all other options
+func mongodb_client_options() (*options.ClientOptions, error) {
+	mongo_uri := mongodb_connection_uri()
+
+	if mongo_uri != "" {
+		client_options := options.Client().ApplyURI(mongo_uri)
+
+		if err := client_options.Validate(); err != nil {
+			return nil, fmt.Errorf("Cannot parse MongoDB URI: %w", err)
+		}
+
+		return client_options, nil
+	}
+
+	client_options := options.Client().SetHosts(mongodb_hosts())
+
+	// We pass credentials separately and they do not need any escaping
+	if global_db_conf.Database_username != "" {
+		client_options.SetAuth(options.Credential{
+			Username:   global_db_conf.Database_username,
+			Password:   global_db_conf.Database_password,
+			AuthSource: global_db_conf.Auth_source,
+		})
+	}
+
+	if global_db_conf.Mongodb_replica_set != "" {
+		client_options.SetReplicaSet(global_db_conf.Mongodb_replica_set)
+	}
+
+	if global_db_conf.Mongodb_connect_timeout > 0 {
+		client_options.SetConnectTimeout(time.Duration(global_db_conf.Mongodb_connect_timeout) * time.Second)
+	}
+
+	if global_db_conf.Mongodb_socket_timeout > 0 {
+		client_options.SetSocketTimeout(time.Duration(global_db_conf.Mongodb_socket_timeout) * time.Second)
+	}
+
+	if global_db_conf.Mongodb_tls || global_db_conf.Mongodb_tls_ca_file != "" || global_db_conf.Mongodb_tls_cert_file != "" {
+		tls_config, err := mongodb_tls_config()
+
+		if err != nil {
+			return nil, err
+		}
+
+		client_options.SetTLSConfig(tls_config)
+	}
+
+	if global_db_conf.Mongodb_read_concern != "" {
+		if err := validate_mongodb_read_concern(global_db_conf.Mongodb_read_concern); err != nil {
+			return nil, err
+		}
+
+		client_options.SetReadConcern(readconcern.New(readconcern.Level(global_db_conf.Mongodb_read_concern)))
+	}
+
+	if global_db_conf.Mongodb_write_concern != "" {
+		write_concern, err := mongodb_write_concern(global_db_conf.Mongodb_write_concern)
+
+		if err != nil {
+			return nil, err
+		}
+
+		client_options.SetWriteConcern(write_concern)
+	}
+
+	if err := client_options.Validate(); err != nil {
+		return nil, fmt.Errorf("Incorrect MongoDB connection options: %w", err)
+	}
+
+	return client_options, nil
+}
+
+// Reads MongoDB password generated by FastNetMon installer, it overrides password from configuration
+func read_mongodb_password() error {
+	if !is_file_exists(mongodb_password_path) {
+		return nil
+	}
+
+	fastnetmon_password_binary, err := ioutil.ReadFile(mongodb_password_path)
+
+	if err != nil {
+		return fmt.Errorf("Cannot read MongoDB password from %s: %w", mongodb_password_path, err)
+	}
+
+	global_db_conf.Database_password = string(fastnetmon_password_binary)
+
+	return nil
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"github.com/ClickHouse/clickhouse-go/lib/column"
+)
+
+// IPv6 address as 128 bit number, IPv4 addresses are mapped into ::ffff:0:0/96 like toIPv6 does in Clickhouse
+type ip_address struct {
+	high uint64
+	low  uint64
+}
+
+// Range of addresses including first and last address
+type address_range struct {
+	first ip_address
+	last  ip_address
+}
+
+// Network with prefix length in 128 bit address space
+type address_network struct {
+	address       ip_address
+	prefix_length int
+}
+
+func new_ip_address(ip net.IP) ip_address {
+	ip16 := ip.To16()
+
+	return ip_address{high: binary.BigEndian.Uint64(ip16[:8]), low: binary.BigEndian.Uint64(ip16[8:])}
+}
+
+func (address ip_address) ip() net.IP {
+	ip := make(net.IP, net.IPv6len)
+
+	binary.BigEndian.PutUint64(ip[:8], address.high)
+	binary.BigEndian.PutUint64(ip[8:], address.low)
+
+	return ip
+}
+
+func (address ip_address) compare(other ip_address) int {
+	switch {
+	case address.high < other.high:
+		return -1
+	case address.high > other.high:
+		return 1
+	case address.low < other.low:
+		return -1
+	case address.low > other.low:
+		return 1
+	}
+
+	return 0
+}
+
+func (address ip_address) is_max() bool {
+	return address.high == ^uint64(0) && address.low == ^uint64(0)
+}
+
+// Returns next address, it must not be called for last address
+func (address ip_address) next() ip_address {
+	if address.low == ^uint64(0) {
+		return ip_address{high: address.high + 1}
+	}
+
+	return ip_address{high: address.high, low: address.low + 1}
+}
+
+// Returns previous address, it must not be called for zero address
+func (address ip_address) previous() ip_address {
+	if address.low == 0 {
+		return ip_address{high: address.high - 1, low: ^uint64(0)}
+	}
+
+	return ip_address{high: address.high, low: address.low - 1}
+}
+
+// Returns address with all host bits set to one
+func (address ip_address) with_host_bits(host_bits int) ip_address {
+	mask := host_bits_mask(host_bits)
+
+	return ip_address{high: address.high | mask.high, low: address.low | mask.low}
+}
+
+// Returns mask which has specified number of lower bits set
+func host_bits_mask(host_bits int) ip_address {
+	switch {
+	case host_bits <= 0:
+		return ip_address{}
+	case host_bits < 64:
+		return ip_address{low: 1<<uint(host_bits) - 1}
+	case host_bits < 128:
+		return ip_address{high: 1<<uint(host_bits-64) - 1, low: ^uint64(0)}
+	}
+
+	return ip_address{high: ^uint64(0), low: ^uint64(0)}
+}
+
+// Returns number of zero bits at the end of address
+func (address ip_address) trailing_zeros() int {
+	if address.low != 0 {
+		return bits.TrailingZeros64(address.low)
+	}
+
+	if address.high != 0 {
+		return 64 + bits.TrailingZeros64(address.high)
+	}
+
+	return 128
+}
+
+// Returns range of addresses for network
+func network_address_range(network *net.IPNet) address_range {
+	ones, bits := network.Mask.Size()
+
+	// IPv4 networks occupy last 32 bits of ::ffff:0:0/96
+	if bits == 32 {
+		ones += 96
+	}
+
+	first := new_ip_address(network.IP.Mask(network.Mask))
+
+	return address_range{first: first, last: first.with_host_bits(128 - ones)}
+}
+
+// Sorts ranges and merges overlapping and adjacent ones
+func merge_address_ranges(ranges []address_range) []address_range {
+	sorted_ranges := append([]address_range{}, ranges...)
+
+	sort.Slice(sorted_ranges, func(i, j int) bool {
+		return sorted_ranges[i].first.compare(sorted_ranges[j].first) < 0
+	})
+
+	merged_ranges := []address_range{}
+
+	for _, current_range := range sorted_ranges {
+		if len(merged_ranges) > 0 {
+			last_range := &merged_ranges[len(merged_ranges)-1]
+
+			if last_range.last.is_max() || current_range.first.compare(last_range.last.next()) <= 0 {
+				if current_range.last.compare(last_range.last) > 0 {
+					last_range.last = current_range.last
+				}
+
+				continue
+			}
+		}
+
+		merged_ranges = append(merged_ranges, current_range)
+	}
+
+	return merged_ranges
+}
+
+// Returns parts of ranges which are not covered by removed ranges, both lists must be merged
+func subtract_address_ranges(ranges []address_range, removed_ranges []address_range) []address_range {
+	result := []address_range{}
+
+	for _, current_range := range ranges {
+		first := current_range.first
+		finished := false
+
+		for _, removed_range := range removed_ranges {
+			if removed_range.last.compare(first) < 0 || removed_range.first.compare(current_range.last) > 0 {
+				continue
+			}
+
+			if removed_range.first.compare(first) > 0 {
+				result = append(result, address_range{first: first, last: removed_range.first.previous()})
+			}
+
+			if removed_range.last.compare(current_range.last) >= 0 {
+				finished = true
+				break
+			}
+
+			first = removed_range.last.next()
+		}
+
+		if !finished {
+			result = append(result, address_range{first: first, last: current_range.last})
+		}
+	}
+
+	return result
+}
+
+// Splits range into smallest list of networks which cover it
+func address_range_networks(current_range address_range) []address_network {
+	networks := []address_network{}
+	first := current_range.first
+
+	for {
+		// Largest network which starts from first address and fits into range
+		host_bits := first.trailing_zeros()
+
+		for host_bits > 0 && first.with_host_bits(host_bits).compare(current_range.last) > 0 {
+			host_bits--
+		}
+
+		networks = append(networks, address_network{address: first, prefix_length: 128 - host_bits})
+
+		network_last := first.with_host_bits(host_bits)
+
+		if network_last.compare(current_range.last) >= 0 {
+			return networks
+		}
+
+		first = network_last.next()
+	}
+}
+
+// Parses networks and returns merged ranges of them, we skip networks with bad format
+func parse_network_ranges(networks_list []string) []address_range {
+	ranges := []address_range{}
+
+	for _, network_string := range networks_list {
+		_, network, err := net.ParseCIDR(network_string)
+
+		if err != nil {
+			fast_logger.Printf("Format error for prefix %s: %v", network_string, err)
+			continue
+		}
+
+		ranges = append(ranges, network_address_range(network))
+	}
+
+	return merge_address_ranges(ranges)
+}
+
+// Range of IPv4-mapped addresses ::ffff:0:0/96
+var ipv4_mapped_range = address_range{first: ip_address{low: 0xffff << 32}, last: ip_address{low: 0xffffffffffff}}
+
+// Returns true when address is IPv4-mapped IPv6 address
+func (address ip_address) is_ipv4() bool {
+	return ipv4_mapped_range.first.compare(address) <= 0 && address.compare(ipv4_mapped_range.last) <= 0
+}
+
+// Returns IPv4 address for IPv4-mapped address and IPv6 address otherwise
+func (address ip_address) string() string {
+	if address.is_ipv4() {
+		return address.ip().To4().String()
+	}
+
+	return address.ip().String()
+}
+
+// Splits merged ranges into IPv4 and IPv6 ones, range which crosses border of ::ffff:0:0/96 is cut into parts
+func split_address_ranges_by_family(ranges []address_range) ([]address_range, []address_range) {
+	ipv4_ranges := []address_range{}
+
+	for _, current_range := range ranges {
+		if current_range.last.compare(ipv4_mapped_range.first) < 0 || current_range.first.compare(ipv4_mapped_range.last) > 0 {
+			continue
+		}
+
+		ipv4_range := current_range
+
+		if ipv4_range.first.compare(ipv4_mapped_range.first) < 0 {
+			ipv4_range.first = ipv4_mapped_range.first
+		}
+
+		if ipv4_range.last.compare(ipv4_mapped_range.last) > 0 {
+			ipv4_range.last = ipv4_mapped_range.last
+		}
+
+		ipv4_ranges = append(ipv4_ranges, ipv4_range)
+	}
+
+	return ipv4_ranges, subtract_address_ranges(ranges, []address_range{ipv4_mapped_range})
+}
+
+// Generates condition which selects hosts from merged ranges
+// We compare addresses with ranges in query when we have few ranges and pass networks as external table otherwise
+// IPv4 hosts are compared with toIPv4 because toIPv6 returns :: for IPv4 strings in older Clickhouse versions
+func generate_address_ranges_condition(ranges []address_range) built_query {
+	if len(ranges) == 0 {
+		return query_text("1 = 0")
+	}
+
+	if int64(len(ranges)) > configuration.NetworkTableThreshold {
+		return generate_network_table_condition(ranges)
+	}
+
+	ipv4_ranges, ipv6_ranges := split_address_ranges_by_family(ranges)
+
+	return generate_address_family_condition(generate_ranges_comparison("toIPv4", ipv4_ranges), generate_ranges_comparison("toIPv6", ipv6_ranges))
+}
+
+// Compares host with ranges of one address family using conversion function for it
+// Addresses come from configuration and we pass them as bound parameters
+func generate_ranges_comparison(conversion_function string, ranges []address_range) []built_query {
+	conditions := []built_query{}
+	function := query_text(conversion_function)
+
+	for _, current_range := range ranges {
+		first := bind_query_parameter(current_range.first.string())
+
+		if current_range.first == current_range.last {
+			conditions = append(conditions, format_query("%s(host) = %s(%s)", function, function, first))
+		} else {
+			conditions = append(conditions, format_query("(%s(host) BETWEEN %s(%s) AND %s(%s))", function, function, first, function, bind_query_parameter(current_range.last.string())))
+		}
+	}
+
+	return conditions
+}
+
+// Joins conditions for IPv4 and IPv6 hosts, we check family of host first because toIPv4 fails for IPv6 addresses in new Clickhouse versions
+func generate_address_family_condition(ipv4_conditions []built_query, ipv6_conditions []built_query) built_query {
+	conditions := []built_query{}
+
+	if len(ipv4_conditions) > 0 {
+		conditions = append(conditions, format_query("(position(host, ':') = 0 AND (%s))", join_queries(ipv4_conditions, " OR ")))
+	}
+
+	if len(ipv6_conditions) > 0 {
+		conditions = append(conditions, format_query("(position(host, ':') > 0 AND (%s))", join_queries(ipv6_conditions, " OR ")))
+	}
+
+	return join_queries(conditions, " OR ")
+}
+
+// Generates condition which looks up host in external tables with networks for ranges
+// IPv4 and IPv6 networks go to separate tables because we convert hosts of every family by own function
+func generate_network_table_condition(ranges []address_range) built_query {
+	ipv4_ranges, ipv6_ranges := split_address_ranges_by_family(ranges)
+
+	return generate_address_family_condition(generate_network_table_lookup("IPv4", ipv4_ranges), generate_network_table_lookup("IPv6", ipv6_ranges))
+}
+
+// Builds external table with networks of one address family and returns lookups of host in it
+// For every prefix length we cut host address to network address and search it in set of networks with same length
+func generate_network_table_lookup(address_family string, ranges []address_range) []built_query {
+	if len(ranges) == 0 {
+		return []built_query{}
+	}
+
+	networks := []address_network{}
+
+	for _, current_range := range ranges {
+		networks = append(networks, address_range_networks(current_range)...)
+	}
+
+	hashed_networks := strings.Builder{}
+	values := [][]driver.Value{}
+	prefix_lengths := map[int]bool{}
+
+	fmt.Fprintf(&hashed_networks, "%s:", address_family)
+
+	for _, network := range networks {
+		address := network.address.ip()
+		prefix_length := network.prefix_length
+
+		// IPv4 networks occupy last 32 bits of ::ffff:0:0/96
+		if address_family == "IPv4" {
+			address = address.To4()
+			prefix_length -= 96
+		}
+
+		values = append(values, []driver.Value{address, uint8(prefix_length)})
+		prefix_lengths[prefix_length] = true
+
+		fmt.Fprintf(&hashed_networks, "%s/%d,", address, prefix_length)
+	}
+
+	network_column, _ := column.Factory("network", address_family, nil)
+	prefix_column, _ := column.Factory("prefix_length", "UInt8", nil)
+
+	table := bind_external_table(clickhouse.ExternalTable{Values: values, Columns: []column.Column{network_column, prefix_column}}, hashed_networks.String())
+
+	sorted_prefix_lengths := []int{}
+
+	for prefix_length := range prefix_lengths {
+		sorted_prefix_lengths = append(sorted_prefix_lengths, prefix_length)
+	}
+
+	sort.Ints(sorted_prefix_lengths)
+
+	conditions := []built_query{}
+
+	for _, prefix_length := range sorted_prefix_lengths {
+		lookup := fmt.Sprintf("(%sCIDRToRange(to%s(host), %d).1 IN (SELECT network FROM %%s WHERE prefix_length = %d))", address_family, address_family, prefix_length, prefix_length)
+		conditions = append(conditions, format_query(lookup, table))
+	}
+
+	return conditions
+}
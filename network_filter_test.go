@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// Builds range from first and last address
+func test_address_range(t *testing.T, first string, last string) address_range {
+	first_ip := net.ParseIP(first)
+	last_ip := net.ParseIP(last)
+
+	if first_ip == nil || last_ip == nil {
+		t.Fatalf("Bad range %s-%s in test", first, last)
+	}
+
+	return address_range{first: new_ip_address(first_ip), last: new_ip_address(last_ip)}
+}
+
+// Formats ranges as first-last list which is easy to compare
+func format_address_ranges(ranges []address_range) string {
+	formatted_ranges := []string{}
+
+	for _, current_range := range ranges {
+		formatted_ranges = append(formatted_ranges, current_range.first.string()+"-"+current_range.last.string())
+	}
+
+	return strings.Join(formatted_ranges, ", ")
+}
+
+func TestIPAddressCarryBetweenHalves(t *testing.T) {
+	address := new_ip_address(net.ParseIP("2001:db8:0:1:ffff:ffff:ffff:ffff"))
+
+	if next := address.next().string(); next != "2001:db8:0:2::" {
+		t.Errorf("Next address must carry into high half, we have %s", next)
+	}
+
+	if previous := address.next().previous(); previous != address {
+		t.Errorf("Previous address must borrow from high half, we have %s", previous.string())
+	}
+
+	max_address := new_ip_address(net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"))
+
+	if !max_address.is_max() || address.is_max() {
+		t.Errorf("Only ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff is last address")
+	}
+}
+
+func TestNetworkAddressRange(t *testing.T) {
+	test_cases := []struct {
+		network  string
+		expected string
+	}{
+		{"10.0.0.0/8", "10.0.0.0-10.255.255.255"},
+		{"192.0.2.7/32", "192.0.2.7-192.0.2.7"},
+		{"0.0.0.0/0", "0.0.0.0-255.255.255.255"},
+		{"2001:db8::/32", "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"2001:db8::/64", "2001:db8::-2001:db8::ffff:ffff:ffff:ffff"},
+		{"2001:db8::/65", "2001:db8::-2001:db8::7fff:ffff:ffff:ffff"},
+		{"::/0", "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+
+	for _, test_case := range test_cases {
+		_, network, err := net.ParseCIDR(test_case.network)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if formatted := format_address_ranges([]address_range{network_address_range(network)}); formatted != test_case.expected {
+			t.Errorf("Network %s must have range %s, we have %s", test_case.network, test_case.expected, formatted)
+		}
+	}
+}
+
+func TestMergeAddressRanges(t *testing.T) {
+	test_cases := []struct {
+		name     string
+		networks []string
+		expected string
+	}{
+		{"empty", []string{}, ""},
+		{"nested", []string{"10.0.0.0/8", "10.1.0.0/16"}, "10.0.0.0-10.255.255.255"},
+		{"adjacent", []string{"10.0.1.0/24", "10.0.0.0/24"}, "10.0.0.0-10.0.1.255"},
+		{"separate", []string{"10.0.2.0/24", "10.0.0.0/24"}, "10.0.0.0-10.0.0.255, 10.0.2.0-10.0.2.255"},
+		{"same", []string{"10.0.0.0/24", "10.0.0.0/24"}, "10.0.0.0-10.0.0.255"},
+		{"adjacent across halves", []string{"2001:db8::/64", "2001:db8:0:1::/64"}, "2001:db8::-2001:db8:0:1:ffff:ffff:ffff:ffff"},
+		{"mixed families", []string{"2001:db8::/32", "10.0.0.0/8"}, "10.0.0.0-10.255.255.255, 2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"last address", []string{"ffff::/16", "::/0", "10.0.0.0/8"}, "::-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"invalid skipped", []string{"10.0.0.0/33", "10.0.0.0/24"}, "10.0.0.0-10.0.0.255"},
+	}
+
+	for _, test_case := range test_cases {
+		if formatted := format_address_ranges(parse_network_ranges(test_case.networks)); formatted != test_case.expected {
+			t.Errorf("%s: expected %s, we have %s", test_case.name, test_case.expected, formatted)
+		}
+	}
+}
+
+func TestSubtractAddressRanges(t *testing.T) {
+	test_cases := []struct {
+		name     string
+		ranges   []string
+		removed  []string
+		expected string
+	}{
+		{"nothing removed", []string{"10.0.0.0/8"}, []string{}, "10.0.0.0-10.255.255.255"},
+		{"middle", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, "10.0.0.0-10.0.255.255, 10.2.0.0-10.255.255.255"},
+		{"start", []string{"10.0.0.0/8"}, []string{"10.0.0.0/9"}, "10.128.0.0-10.255.255.255"},
+		{"end", []string{"10.0.0.0/8"}, []string{"10.128.0.0/9"}, "10.0.0.0-10.127.255.255"},
+		{"everything", []string{"10.1.0.0/16"}, []string{"10.0.0.0/8"}, ""},
+		{"few holes", []string{"10.0.0.0/16"}, []string{"10.0.1.0/24", "10.0.3.0/24"}, "10.0.0.0-10.0.0.255, 10.0.2.0-10.0.2.255, 10.0.4.0-10.0.255.255"},
+		{"other family", []string{"10.0.0.0/8"}, []string{"2001:db8::/32"}, "10.0.0.0-10.255.255.255"},
+		{"across halves", []string{"2001:db8::/63"}, []string{"2001:db8::/64"}, "2001:db8:0:1::-2001:db8:0:1:ffff:ffff:ffff:ffff"},
+		{"hole in 128 bit range", []string{"2001:db8::/32"}, []string{"2001:db8::/64"}, "2001:db8:0:1::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"up to last address", []string{"::/0"}, []string{"ffff::/16"}, "::-fffe:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+
+	for _, test_case := range test_cases {
+		result := subtract_address_ranges(parse_network_ranges(test_case.ranges), parse_network_ranges(test_case.removed))
+
+		if formatted := format_address_ranges(result); formatted != test_case.expected {
+			t.Errorf("%s: expected %s, we have %s", test_case.name, test_case.expected, formatted)
+		}
+	}
+}
+
+// Prefix lengths of networks are in 128 bit address space, IPv4 /24 is /120
+func TestAddressRangeNetworks(t *testing.T) {
+	test_cases := []struct {
+		first    string
+		last     string
+		expected string
+	}{
+		{"10.0.0.0", "10.0.2.255", "10.0.0.0/119, 10.0.2.0/120"},
+		{"10.0.0.1", "10.0.0.1", "10.0.0.1/128"},
+		{"10.0.0.255", "10.0.1.0", "10.0.0.255/128, 10.0.1.0/128"},
+		{"2001:db8::", "2001:db8:0:1:ffff:ffff:ffff:ffff", "2001:db8::/63"},
+		{"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "::/0"},
+	}
+
+	for _, test_case := range test_cases {
+		formatted_networks := []string{}
+
+		for _, network := range address_range_networks(test_address_range(t, test_case.first, test_case.last)) {
+			formatted_networks = append(formatted_networks, network.address.string()+"/"+strconv.Itoa(network.prefix_length))
+		}
+
+		if formatted := strings.Join(formatted_networks, ", "); formatted != test_case.expected {
+			t.Errorf("Range %s-%s must be covered by %s, we have %s", test_case.first, test_case.last, test_case.expected, formatted)
+		}
+	}
+}
+
+func TestSplitAddressRangesByFamily(t *testing.T) {
+	test_cases := []struct {
+		name   string
+		ranges []address_range
+		ipv4   string
+		ipv6   string
+	}{
+		{"IPv4 only", []address_range{test_address_range(t, "10.0.0.0", "10.255.255.255")}, "10.0.0.0-10.255.255.255", ""},
+		{"IPv6 only", []address_range{test_address_range(t, "2001:db8::", "2001:db8::ff")}, "", "2001:db8::-2001:db8::ff"},
+		{
+			"both",
+			[]address_range{test_address_range(t, "10.0.0.0", "10.0.0.255"), test_address_range(t, "2001:db8::", "2001:db8::ff")},
+			"10.0.0.0-10.0.0.255",
+			"2001:db8::-2001:db8::ff",
+		},
+		{"across border of IPv4-mapped range", []address_range{test_address_range(t, "::fffe:0:0", "::1:0:0:1")}, "0.0.0.0-255.255.255.255", "::fffe:0:0-::fffe:ffff:ffff, ::1:0:0:0-::1:0:0:1"},
+		{"all addresses", parse_network_ranges([]string{"::/0"}), "0.0.0.0-255.255.255.255", "::-::fffe:ffff:ffff, ::1:0:0:0-ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+
+	for _, test_case := range test_cases {
+		ipv4_ranges, ipv6_ranges := split_address_ranges_by_family(test_case.ranges)
+
+		if formatted := format_address_ranges(ipv4_ranges); formatted != test_case.ipv4 {
+			t.Errorf("%s: expected IPv4 ranges %s, we have %s", test_case.name, test_case.ipv4, formatted)
+		}
+
+		if formatted := format_address_ranges(ipv6_ranges); formatted != test_case.ipv6 {
+			t.Errorf("%s: expected IPv6 ranges %s, we have %s", test_case.name, test_case.ipv6, formatted)
+		}
+	}
+}
+
+func TestGenerateNetworkWhereClause(t *testing.T) {
+	configuration = BaselineExporterConfiguration{NetworkTableThreshold: 1000}
+
+	test_cases := []struct {
+		name     string
+		networks []string
+		expected string
+	}{
+		{"empty list", []string{}, "1 = 1"},
+		{"all invalid", []string{"10.0.0.0/33", "not a network"}, "1 = 0"},
+		{"single host", []string{"192.0.2.7/32"}, "(position(host, ':') = 0 AND (toIPv4(host) = toIPv4('192.0.2.7')))"},
+		{
+			"mixed families",
+			[]string{"2001:db8::/32", "10.0.0.0/8", "10.1.0.0/16"},
+			"(position(host, ':') = 0 AND ((toIPv4(host) BETWEEN toIPv4('10.0.0.0') AND toIPv4('10.255.255.255')))) OR " +
+				"(position(host, ':') > 0 AND ((toIPv6(host) BETWEEN toIPv6('2001:db8::') AND toIPv6('2001:db8:ffff:ffff:ffff:ffff:ffff:ffff'))))",
+		},
+	}
+
+	for _, test_case := range test_cases {
+		if where_clause := generate_network_where_clause(test_case.networks).inlined(); where_clause != test_case.expected {
+			t.Errorf("%s: expected %s, we have %s", test_case.name, test_case.expected, where_clause)
+		}
+	}
+}
+
+func TestNetworkTableThreshold(t *testing.T) {
+	networks := []string{"10.0.0.0/24", "10.0.2.0/24", "2001:db8::/48"}
+
+	test_cases := []struct {
+		threshold      int64
+		external_table bool
+	}{
+		{3, false},
+		{2, true},
+		{1, true},
+	}
+
+	for _, test_case := range test_cases {
+		configuration = BaselineExporterConfiguration{NetworkTableThreshold: test_case.threshold}
+
+		where_clause := generate_network_where_clause(networks)
+
+		tables := []clickhouse.ExternalTable{}
+
+		for _, argument := range where_clause.arguments() {
+			if table, ok := argument.(sql.NamedArg).Value.(clickhouse.ExternalTable); ok {
+				tables = append(tables, table)
+			}
+		}
+
+		if !test_case.external_table {
+			if len(tables) > 0 || strings.Contains(where_clause.sql, "CIDRToRange") {
+				t.Errorf("Threshold %d: we must compare with ranges in query, we have %s", test_case.threshold, where_clause.sql)
+			}
+
+			continue
+		}
+
+		// We have separate table for every address family
+		if len(tables) != 2 || len(tables[0].Values) != 2 || len(tables[1].Values) != 1 {
+			t.Errorf("Threshold %d: we must have IPv4 table with 2 networks and IPv6 table with 1 network, we have %+v", test_case.threshold, tables)
+		}
+
+		for _, lookup := range []string{"IPv4CIDRToRange(toIPv4(host), 24).1 IN", "IPv6CIDRToRange(toIPv6(host), 48).1 IN"} {
+			if !strings.Contains(where_clause.sql, lookup) {
+				t.Errorf("Threshold %d: query must have %s: %s", test_case.threshold, lookup, where_clause.sql)
+			}
+		}
+	}
+}
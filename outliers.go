@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Checks outlier rejection options from configuration
+func validate_outlier_configuration() error {
+	switch configuration.OutlierRejection {
+	case "":
+		return nil
+	case "median":
+		if configuration.OutlierMedianMultiplier <= 0 {
+			return fmt.Errorf("outlier_median_multiplier must be positive, we have %g", configuration.OutlierMedianMultiplier)
+		}
+	case "mad":
+		if configuration.OutlierMadMultiplier <= 0 {
+			return fmt.Errorf("outlier_mad_multiplier must be positive, we have %g", configuration.OutlierMadMultiplier)
+		}
+	default:
+		return fmt.Errorf("outlier_rejection must be median or mad, we have %s", configuration.OutlierRejection)
+	}
+
+	return nil
+}
+
+// Generates SQL query which calculates median of all metric columns
+func generate_outlier_medians_query(host_group Ban_settings_t, window calculation_window) built_query {
+	source := generate_metrics_source(host_group, window)
+
+	medians := processMap(traffic_metric_columns, func(value string) string {
+		return aggregate_function_call("median", "", nil, value)
+	})
+
+	return new_select_query(medians...).from(source.table).where(source.where_clause).build()
+}
+
+// Generates SQL query which calculates median absolute deviation of all metric columns
+func generate_outlier_deviations_query(host_group Ban_settings_t, window calculation_window, medians map[string]float64) built_query {
+	source := generate_metrics_source(host_group, window)
+
+	deviations := processMap(traffic_metric_columns, func(value string) string {
+		median := medians[value]
+
+		// Median of empty column is NaN, we skip such columns anyway and need only valid query
+		if !is_finite_number(median) {
+			median = 0
+		}
+
+		return aggregate_function_call("median", "", nil, fmt.Sprintf("abs(%s - %s)", value, format_outlier_bound(median)))
+	})
+
+	return new_select_query(deviations...).from(source.table).where(source.where_clause).build()
+}
+
+// Executes query which returns one number for every metric column
+func query_value_per_column(ctx context.Context, clickhouse_client *sql.DB, query built_query) (map[string]float64, error) {
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("SQL Query: %s\n", query.sql)
+	}
+
+	values := make([]float64, len(traffic_metric_columns))
+	destinations := []interface{}{}
+
+	for index := range values {
+		destinations = append(destinations, &values[index])
+	}
+
+	query_ctx, cancel := with_query_timeout(ctx)
+	defer cancel()
+
+	err := clickhouse_client.QueryRowContext(query_ctx, query.sql, query.arguments()...).Scan(destinations...)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w", query.sql, err)
+	}
+
+	values_per_column := map[string]float64{}
+
+	for index, column := range traffic_metric_columns {
+		values_per_column[column] = values[index]
+	}
+
+	return values_per_column, nil
+}
+
+// Returns false for NaN and infinite values which Clickhouse returns for empty columns
+func is_finite_number(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
+
+// Formats bound for Clickhouse query without loss of precision
+func format_outlier_bound(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// Calculates conditions which keep only normal samples for every metric column
+// It returns nil when outlier rejection is disabled
+func calculate_outlier_conditions(ctx context.Context, host_group Ban_settings_t, clickhouse_client *sql.DB, window calculation_window) (map[string]string, error) {
+	if configuration.OutlierRejection == "" {
+		return nil, nil
+	}
+
+	medians, err := query_value_per_column(ctx, clickhouse_client, generate_outlier_medians_query(host_group, window))
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate medians: %w", err)
+	}
+
+	if configuration.OutlierRejection == "median" {
+		return generate_outlier_conditions(medians, nil), nil
+	}
+
+	deviations, err := query_value_per_column(ctx, clickhouse_client, generate_outlier_deviations_query(host_group, window, medians))
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot calculate median absolute deviations: %w", err)
+	}
+
+	return generate_outlier_conditions(medians, deviations), nil
+}
+
+// Generates conditions from medians and median absolute deviations, deviations are nil for median rejection
+// We do not trim columns with zero median or deviation because it would remove all non zero samples
+// Columns with NaN or infinite median or deviation are not trimmed too, we would get invalid or empty condition
+func generate_outlier_conditions(medians map[string]float64, deviations map[string]float64) map[string]string {
+	conditions := map[string]string{}
+
+	for _, column := range traffic_metric_columns {
+		median := medians[column]
+
+		if !is_finite_number(median) {
+			continue
+		}
+
+		if deviations == nil {
+			if median <= 0 {
+				continue
+			}
+
+			conditions[column] = fmt.Sprintf("%s <= %s", column, format_outlier_bound(median*configuration.OutlierMedianMultiplier))
+			continue
+		}
+
+		deviation := deviations[column]
+
+		if !is_finite_number(deviation) || deviation <= 0 {
+			continue
+		}
+
+		lower_bound := median - deviation*configuration.OutlierMadMultiplier
+		upper_bound := median + deviation*configuration.OutlierMadMultiplier
+
+		conditions[column] = fmt.Sprintf("%s >= %s AND %s <= %s", column, format_outlier_bound(lower_bound), column, format_outlier_bound(upper_bound))
+	}
+
+	return conditions
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestOutlierConditionsSkipInvalidValues(t *testing.T) {
+	configuration = BaselineExporterConfiguration{OutlierMedianMultiplier: 10, OutlierMadMultiplier: 3}
+
+	test_cases := []struct {
+		name      string
+		median    float64
+		deviation float64
+		mad       bool
+		condition string
+	}{
+		{"median", 100, 0, false, "packets_incoming <= 1000"},
+		{"zero median", 0, 0, false, ""},
+		{"NaN median", math.NaN(), 0, false, ""},
+		{"infinite median", math.Inf(1), 0, false, ""},
+		{"mad", 100, 20, true, "packets_incoming >= 40 AND packets_incoming <= 160"},
+		{"zero deviation", 100, 0, true, ""},
+		{"NaN median with deviation", math.NaN(), 20, true, ""},
+		{"NaN deviation", 100, math.NaN(), true, ""},
+		{"infinite deviation", 100, math.Inf(-1), true, ""},
+	}
+
+	for _, test_case := range test_cases {
+		medians := map[string]float64{"packets_incoming": test_case.median}
+		var deviations map[string]float64
+
+		if test_case.mad {
+			deviations = map[string]float64{"packets_incoming": test_case.deviation}
+		}
+
+		conditions := generate_outlier_conditions(medians, deviations)
+
+		if conditions["packets_incoming"] != test_case.condition {
+			t.Errorf("%s: expected condition %q, we have %q", test_case.name, test_case.condition, conditions["packets_incoming"])
+		}
+
+		// Columns without values are NaN in results from Clickhouse too and must not get condition
+		if len(conditions) > 1 {
+			t.Errorf("%s: we have conditions for columns without values: %v", test_case.name, conditions)
+		}
+	}
+}
+
+func TestOutlierDeviationsQueryHasNoNaN(t *testing.T) {
+	window := setup_query_builder_test(t, 1000, "")
+
+	query := generate_outlier_deviations_query(find_query_test_host_group(t, "customers"), window, map[string]float64{"packets_incoming": math.NaN()})
+
+	if strings.Contains(query.sql, "NaN") || strings.Contains(query.sql, "Inf") {
+		t.Errorf("Query must not have NaN or Inf bounds: %s", query.sql)
+	}
+}
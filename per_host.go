@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDB collection where we keep baselines for individual hosts
+const hosts_baseline_collection_name = "baseline_exporter_hosts_baseline"
+
+// Structure to store baseline of single host in MongoDB
+type HostBaselineStructure struct {
+	// It can be IPv4 or IPv6
+	Host      string              `bson:"host" json:"host"`
+	Hostgroup string              `bson:"hostgroup" json:"hostgroup"`
+	Incoming  TrafficBaseline     `bson:"incoming" json:"incoming"`
+	Outgoing  TrafficBaseline     `bson:"outgoing" json:"outgoing"`
+	Metadata  CalculationMetadata `bson:"metadata" json:"metadata"`
+}
+
+// Generates SQL query which calculates baselines for every host in hostgroup
+// We keep only busiest hosts to keep it tractable for large networks
+func generate_host_baselines_query(host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window) built_query {
+	source := generate_host_metrics_source(host_group, window)
+
+	fields_for_processing := processMap(traffic_metric_columns, func(value string) string {
+		return strings.Join(generate_statistics_expressions(value, statistics, ""), ",")
+	})
+
+	return new_select_query("host", "COUNT(*) AS samples").columns(fields_for_processing...).
+		from(source.table).where(source.where_clause).group("host").
+		having_condition(fmt.Sprintf("samples >= %d", configuration.PerHostBaselineMinSamples)).
+		order(aggregate_function_call("sum", "", nil, "bits_incoming + bits_outgoing") + " DESC").
+		limit_rows(uint64(configuration.PerHostBaselineMaxHosts)).build()
+}
+
+// Generates baselines for every host in hostgroup
+func generate_host_baselines(ctx context.Context, host_group Ban_settings_t, clickhouse_client *sql.DB, statistics []*traffic_statistic, window calculation_window) ([]*HostBaselineStructure, error) {
+	query := generate_host_baselines_query(host_group, statistics, window)
+
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("SQL Query: %s\n", query.sql)
+	}
+
+	query_ctx, cancel := with_query_timeout(ctx)
+	defer cancel()
+
+	rows, err := clickhouse_client.QueryContext(query_ctx, query.sql, query.arguments()...)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w\n", query.sql, err)
+	}
+
+	defer rows.Close()
+
+	host_baselines := []*HostBaselineStructure{}
+
+	// All hosts in hostgroup have same computation time, we use it to remove hosts which disappeared
+	computed_at := time.Now()
+
+	for rows.Next() {
+		host_baseline := &HostBaselineStructure{Hostgroup: host_group.Name}
+		metrics_row := &BaselineStructure{}
+
+		destinations := []interface{}{&host_baseline.Host, &host_baseline.Metadata.SampleCount}
+
+		column_destinations, apply := baseline_scan_destinations(metrics_row, statistics)
+
+		err := rows.Scan(append(destinations, column_destinations...)...)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read row: %v", err)
+		}
+
+		apply()
+
+		host_baseline.Incoming = metrics_row.Incoming
+		host_baseline.Outgoing = metrics_row.Outgoing
+
+		fill_calculation_metadata(&host_baseline.Metadata, host_group.Name, host_group.Networks, window, statistics_aggregation_function(statistics))
+		host_baseline.Metadata.ComputedAt = computed_at
+		host_baseline.Metadata.DistinctHosts = 1
+		host_baseline.Metadata.Statistics = statistic_names(statistics)
+
+		host_baselines = append(host_baselines, host_baseline)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read rows: %v", err)
+	}
+
+	return host_baselines, nil
+}
+
+// Creates indexes for collection with host baselines
+func ensure_host_baselines_indexes(ctx context.Context, mongo_client *mongo.Client) error {
+	hosts_collection := mongo_client.Database(global_db_conf.Db_name).Collection(hosts_baseline_collection_name)
+
+	_, err := hosts_collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "hostgroup", Value: 1}, {Key: "host", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "host", Value: 1}},
+		},
+	})
+
+	return err
+}
+
+// Replaces baselines of all hosts in hostgroup and removes hosts which we did not see in this run
+// generation_started must be earlier than computation time of all new baselines
+func write_host_baselines(ctx context.Context, mongo_client *mongo.Client, hostgroup_name string, host_baselines []*HostBaselineStructure, generation_started time.Time) error {
+	hosts_collection := mongo_client.Database(global_db_conf.Db_name).Collection(hosts_baseline_collection_name)
+
+	if len(host_baselines) > 0 {
+		write_models := []mongo.WriteModel{}
+
+		for _, host_baseline := range host_baselines {
+			filter := bson.D{{Key: "hostgroup", Value: host_baseline.Hostgroup}, {Key: "host", Value: host_baseline.Host}}
+
+			write_models = append(write_models, mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(host_baseline).SetUpsert(true))
+		}
+
+		_, err := hosts_collection.BulkWrite(ctx, write_models, options.BulkWrite().SetOrdered(false))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := hosts_collection.DeleteMany(ctx, bson.D{
+		{Key: "hostgroup", Value: hostgroup_name},
+		{Key: "metadata.computed_at", Value: bson.D{{Key: "$lt", Value: generation_started}}},
+	})
+
+	return err
+}
+
+// Reads baselines of host from all hostgroups
+func read_host_baselines(ctx context.Context, mongo_client *mongo.Client, host string) ([]HostBaselineStructure, error) {
+	hosts_collection := mongo_client.Database(global_db_conf.Db_name).Collection(hosts_baseline_collection_name)
+
+	cursor, err := hosts_collection.Find(ctx, bson.D{{Key: "host", Value: host}})
+
+	if err != nil {
+		return nil, err
+	}
+
+	host_baselines := []HostBaselineStructure{}
+
+	if err = cursor.All(ctx, &host_baselines); err != nil {
+		return nil, err
+	}
+
+	return host_baselines, nil
+}
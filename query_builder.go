@@ -0,0 +1,330 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"regexp"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// Prefix of bound parameters and external tables which we reference from queries as @name
+const query_argument_prefix = "baseline_exporter_"
+
+// Names of databases, tables and columns which we accept from configuration
+var clickhouse_identifier_pattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Aggregate functions which we allow in queries, combinators like If are added separately
+var clickhouse_aggregate_functions = []string{"count", "sum", "min", "max", "avg", "median", "quantiles", "stddevPop", "uniqExact", "groupArray", "groupUniqArray"}
+
+// Checks name of database, table or column
+func validate_clickhouse_identifier(kind string, name string) error {
+	if !clickhouse_identifier_pattern.MatchString(name) {
+		return fmt.Errorf("%s %s is not valid Clickhouse identifier", kind, name)
+	}
+
+	return nil
+}
+
+// Returns quoted identifier, we escape it too because quoting must be safe even for names which we did not validate
+func quote_clickhouse_identifier(name string) string {
+	return "`" + strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(name) + "`"
+}
+
+// Returns quoted name of table in database
+func clickhouse_table_name(database string, table string) string {
+	return quote_clickhouse_identifier(database) + "." + quote_clickhouse_identifier(table)
+}
+
+// Returns string literal for Clickhouse query
+func quote_clickhouse_string(value string) string {
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(value) + "'"
+}
+
+// Returns true when we allow aggregate function in queries
+func is_allowed_aggregate_function(function string) bool {
+	for _, allowed_function := range clickhouse_aggregate_functions {
+		if function == allowed_function {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Generates call of aggregate function, parameters are for parametric functions like quantiles
+// Names of functions come from our code and configured_statistics checks them against whitelist
+func aggregate_function_call(function string, combinator string, parameters []string, arguments ...string) string {
+	if len(parameters) > 0 {
+		return fmt.Sprintf("%s%s(%s)(%s)", function, combinator, strings.Join(parameters, ","), strings.Join(arguments, ", "))
+	}
+
+	return fmt.Sprintf("%s%s(%s)", function, combinator, strings.Join(arguments, ", "))
+}
+
+// Text of query or its part together with bound parameters and external tables which it references
+// Arguments travel with text, so every query carries exactly values which it needs
+type built_query struct {
+	sql  string
+	args []interface{}
+}
+
+// Returns part of query without arguments
+func query_text(text string) built_query {
+	return built_query{sql: text}
+}
+
+// Returns name of argument which driver sends with query, name depends only on value and same values share same argument
+func query_argument_name(kind string, hashed_value string) string {
+	argument_hash := fnv.New64a()
+	argument_hash.Write([]byte(hashed_value))
+
+	return fmt.Sprintf("%s%s_%016x", query_argument_prefix, kind, argument_hash.Sum64())
+}
+
+// Returns placeholder for value which driver passes as bound parameter
+// It keeps values from configuration and MongoDB out of query text
+func bind_query_parameter(value interface{}) built_query {
+	name := query_argument_name("parameter", fmt.Sprintf("%T:%v", value, value))
+
+	return built_query{sql: "@" + name, args: []interface{}{sql.Named(name, value)}}
+}
+
+// Returns placeholder for external table, hashed_value must identify content of table
+func bind_external_table(table clickhouse.ExternalTable, hashed_value string) built_query {
+	table.Name = query_argument_name("table", hashed_value)
+
+	return built_query{sql: "@" + table.Name, args: []interface{}{sql.Named(table.Name, table)}}
+}
+
+// Formats parts of query into format string like fmt.Sprintf and collects their arguments
+func format_query(format string, parts ...built_query) built_query {
+	texts := []interface{}{}
+	arguments := []interface{}{}
+
+	for _, part := range parts {
+		texts = append(texts, part.sql)
+		arguments = append(arguments, part.args...)
+	}
+
+	return built_query{sql: fmt.Sprintf(format, texts...), args: arguments}
+}
+
+// Joins parts of query by separator and collects their arguments
+func join_queries(parts []built_query, separator string) built_query {
+	texts := []string{}
+	arguments := []interface{}{}
+
+	for _, part := range parts {
+		texts = append(texts, part.sql)
+		arguments = append(arguments, part.args...)
+	}
+
+	return built_query{sql: strings.Join(texts, separator), args: arguments}
+}
+
+// Returns arguments which must be passed to QueryContext or QueryRowContext
+// Same value can be referenced many times and driver expects every name once
+func (query built_query) arguments() []interface{} {
+	arguments := []interface{}{}
+	added_arguments := map[string]bool{}
+
+	for _, argument := range query.args {
+		name := argument.(sql.NamedArg).Name
+
+		if added_arguments[name] {
+			continue
+		}
+
+		added_arguments[name] = true
+		arguments = append(arguments, argument)
+	}
+
+	return arguments
+}
+
+// Replaces bound parameters by values to show query to human, external tables are kept as @name
+func (query built_query) inlined() string {
+	replacements := []string{}
+
+	for _, argument := range query.arguments() {
+		named_argument := argument.(sql.NamedArg)
+
+		switch value := named_argument.Value.(type) {
+		case clickhouse.ExternalTable:
+			continue
+		case string:
+			replacements = append(replacements, "@"+named_argument.Name, quote_clickhouse_string(value))
+		default:
+			replacements = append(replacements, "@"+named_argument.Name, fmt.Sprint(value))
+		}
+	}
+
+	return strings.NewReplacer(replacements...).Replace(query.sql)
+}
+
+// SELECT query which we assemble from parts
+// Expressions and conditions are generated by our code, values from outside must be added with bind_query_parameter
+type select_query struct {
+	expressions []string
+	table       string
+	array_joins []string
+	conditions  []string
+	group_by    []string
+	having      []string
+	order_by    []string
+	limit_by    []string
+	limit       uint64
+
+	// Bound parameters and external tables from all parts of query
+	args []interface{}
+}
+
+// Starts query with list of expressions
+func new_select_query(expressions ...string) *select_query {
+	return &select_query{expressions: expressions}
+}
+
+// Adds arguments of part to query and returns its text, we use it for expressions with bound parameters
+func (query *select_query) bind(part built_query) string {
+	query.args = append(query.args, part.args...)
+	return part.sql
+}
+
+// Adds expressions to SELECT section
+func (query *select_query) columns(expressions ...string) *select_query {
+	query.expressions = append(query.expressions, expressions...)
+	return query
+}
+
+// Selects from table in database
+func (query *select_query) from_table(database string, table string) *select_query {
+	query.table = clickhouse_table_name(database, table)
+	return query
+}
+
+// Selects from table expression like subquery
+func (query *select_query) from(table built_query) *select_query {
+	query.table = query.bind(table)
+	return query
+}
+
+// Selects from subquery
+func (query *select_query) from_subquery(subquery *select_query) *select_query {
+	return query.from(format_query("(%s)", subquery.build()))
+}
+
+// Adds ARRAY JOIN section, it turns every element of array into separate row
+func (query *select_query) array_join(expression string) *select_query {
+	query.array_joins = append(query.array_joins, expression)
+	return query
+}
+
+// Adds condition, all conditions are joined by AND
+func (query *select_query) where(conditions ...built_query) *select_query {
+	for _, condition := range conditions {
+		query.conditions = append(query.conditions, query.bind(condition))
+	}
+
+	return query
+}
+
+func (query *select_query) group(expressions ...string) *select_query {
+	query.group_by = append(query.group_by, expressions...)
+	return query
+}
+
+func (query *select_query) having_condition(conditions ...string) *select_query {
+	query.having = append(query.having, conditions...)
+	return query
+}
+
+func (query *select_query) order(expressions ...string) *select_query {
+	query.order_by = append(query.order_by, expressions...)
+	return query
+}
+
+func (query *select_query) limit_rows(limit uint64) *select_query {
+	query.limit = limit
+	return query
+}
+
+// Keeps only first rows for every value of expressions with LIMIT BY
+func (query *select_query) limit_rows_by(limit uint64, expressions ...string) *select_query {
+	query.limit = limit
+	query.limit_by = expressions
+	return query
+}
+
+// Wraps every condition into brackets and joins them by AND
+func join_conditions(conditions []built_query) built_query {
+	wrapped_conditions := []built_query{}
+
+	for _, condition := range conditions {
+		wrapped_conditions = append(wrapped_conditions, format_query("(%s)", condition))
+	}
+
+	return join_queries(wrapped_conditions, " AND ")
+}
+
+// Returns text of query with its arguments
+func (query *select_query) build() built_query {
+	var builder strings.Builder
+
+	builder.WriteString("SELECT ")
+	builder.WriteString(strings.Join(query.expressions, ", "))
+
+	if query.table != "" {
+		builder.WriteString(" FROM ")
+		builder.WriteString(query.table)
+	}
+
+	if len(query.array_joins) > 0 {
+		builder.WriteString(" ARRAY JOIN ")
+		builder.WriteString(strings.Join(query.array_joins, ", "))
+	}
+
+	if len(query.conditions) > 0 {
+		builder.WriteString(" WHERE ")
+		builder.WriteString(join_conditions(query_texts(query.conditions)).sql)
+	}
+
+	if len(query.group_by) > 0 {
+		builder.WriteString(" GROUP BY ")
+		builder.WriteString(strings.Join(query.group_by, ", "))
+	}
+
+	if len(query.having) > 0 {
+		builder.WriteString(" HAVING ")
+		builder.WriteString(join_conditions(query_texts(query.having)).sql)
+	}
+
+	if len(query.order_by) > 0 {
+		builder.WriteString(" ORDER BY ")
+		builder.WriteString(strings.Join(query.order_by, ", "))
+	}
+
+	if query.limit > 0 {
+		fmt.Fprintf(&builder, " LIMIT %d", query.limit)
+	}
+
+	if len(query.limit_by) > 0 {
+		builder.WriteString(" BY ")
+		builder.WriteString(strings.Join(query.limit_by, ", "))
+	}
+
+	return built_query{sql: builder.String(), args: query.args}
+}
+
+// Returns parts of query without arguments
+func query_texts(texts []string) []built_query {
+	parts := []built_query{}
+
+	for _, text := range texts {
+		parts = append(parts, query_text(text))
+	}
+
+	return parts
+}
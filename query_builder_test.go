@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+)
+
+// Run go test -update to rewrite golden files after intended change of queries
+var update_golden_files = flag.Bool("update", false, "rewrite golden files in testdata")
+
+// Finds references to bound parameters and external tables in query
+var query_argument_reference = regexp.MustCompile(`@(` + query_argument_prefix + `[a-z]+_[0-9a-f]+)`)
+
+// Values from configuration, MongoDB and files, they must reach Clickhouse only as bound parameters
+var user_supplied_values = []string{
+	"customers",
+	"vip_hosts",
+	"everything_else",
+	"uplink",
+	"10.10.",
+	"10.20.",
+	"2001:db8",
+	"192.0.2.",
+	"198.51.100.",
+	"203.0.113.",
+	"Europe/London",
+}
+
+var query_test_host_groups = []Ban_settings_t{
+	{Name: "customers", Networks: []string{"10.10.0.0/16", "2001:db8:10::/48"}},
+	{Name: "vip_hosts", Networks: []string{"10.10.5.0/24", "10.10.7.7/32"}},
+	{Name: "everything_else"},
+	{Name: "uplink", Networks: []string{"10.20.0.0/16"}, Calculation_method: "total"},
+}
+
+// Sets configuration and data from outside which queries use and returns calculation window
+func setup_query_builder_test(t *testing.T, network_table_threshold int64, hostgroup_metrics_table string) calculation_window {
+	configuration = BaselineExporterConfiguration{
+		CalculationPeriod:         604800,
+		AggregationFunction:       "quantile(0.95)",
+		Statistics:                []string{"p99", "max"},
+		SeasonalBucketHours:       4,
+		SeasonalTimezone:          "Europe/London",
+		HostgroupMetricsTable:     hostgroup_metrics_table,
+		PerHostBaselineMaxHosts:   100,
+		PerHostBaselineMinSamples: 60,
+		NetworkTableThreshold:     network_table_threshold,
+	}
+
+	current_global_conf.Clickhouse_metrics_database = "fastnetmon"
+
+	window := new_calculation_window(time.Date(2022, 4, 7, 13, 50, 50, 0, time.UTC))
+
+	attack_exclusions = []AttackExclusion{
+		{Host: "192.0.2.10", Start: window.start.Add(time.Hour), End: window.start.Add(2 * time.Hour)},
+		{Host: "198.51.100.0/24", Start: window.start.Add(3 * time.Hour), End: window.start.Add(4 * time.Hour)},
+		{Start: window.start.Add(5 * time.Hour), End: window.start.Add(6 * time.Hour)},
+	}
+
+	maintenance_calendar = []MaintenanceWindow{
+		{Name: "migration", Start: window.start.Add(24 * time.Hour), End: window.start.Add(26 * time.Hour), Networks: []string{"203.0.113.0/24"}},
+		{Name: "load test", Start: window.start.Add(48 * time.Hour), End: window.start.Add(49 * time.Hour), Hostgroups: []string{"customers", "uplink"}},
+	}
+
+	hostgroup_where_clauses = calculate_hostgroup_where_clauses(query_test_host_groups)
+
+	return window
+}
+
+func find_query_test_host_group(t *testing.T, name string) Ban_settings_t {
+	for _, host_group := range query_test_host_groups {
+		if host_group.Name == name {
+			return host_group
+		}
+	}
+
+	t.Fatalf("We have no hostgroup %s", name)
+	return Ban_settings_t{}
+}
+
+// Returns query and its arguments in format of golden file
+func format_golden_query(query built_query) string {
+	var builder strings.Builder
+
+	builder.WriteString(query.sql)
+	builder.WriteString("\n\n-- Arguments\n")
+
+	for _, argument := range query.arguments() {
+		named_argument := argument.(sql.NamedArg)
+
+		switch value := named_argument.Value.(type) {
+		case clickhouse.ExternalTable:
+			rows := []string{}
+
+			for _, row := range value.Values {
+				rows = append(rows, fmt.Sprintf("%v/%v", row[0], row[1]))
+			}
+
+			fmt.Fprintf(&builder, "%s = external table %s\n", named_argument.Name, strings.Join(rows, ", "))
+		default:
+			fmt.Fprintf(&builder, "%s = %T %v\n", named_argument.Name, value, value)
+		}
+	}
+
+	return builder.String()
+}
+
+// Checks that query text has no values from outside and every reference has argument
+func check_query_arguments(t *testing.T, query built_query) {
+	for _, value := range user_supplied_values {
+		if strings.Contains(query.sql, value) {
+			t.Errorf("Query text has value %s from outside: %s", value, query.sql)
+		}
+	}
+
+	arguments := map[string]bool{}
+
+	for _, argument := range query.arguments() {
+		arguments[argument.(sql.NamedArg).Name] = true
+	}
+
+	referenced := map[string]bool{}
+
+	for _, match := range query_argument_reference.FindAllStringSubmatch(query.sql, -1) {
+		referenced[match[1]] = true
+
+		if !arguments[match[1]] {
+			t.Errorf("Query references @%s without argument", match[1])
+		}
+	}
+
+	for name := range arguments {
+		if !referenced[name] {
+			t.Errorf("Query has argument %s which it does not reference", name)
+		}
+	}
+}
+
+func TestQueriesMatchGoldenFiles(t *testing.T) {
+	test_cases := []struct {
+		name                    string
+		network_table_threshold int64
+		hostgroup_metrics_table string
+		generate                func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query
+	}{
+		{
+			name: "baseline",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_baseline_query(find_query_test_host_group(t, "customers"), statistics, window, nil)
+			},
+		},
+		{
+			name: "top_talkers",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_top_talkers_query("customers", []string{"10.10.0.0/16", "2001:db8:10::/48"}, 10, window, []string{"packets_incoming", "bits_incoming"})
+			},
+		},
+		{
+			name: "seasonal_baseline",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_seasonal_baseline_query(find_query_test_host_group(t, "customers"), statistics, window, nil)
+			},
+		},
+		{
+			name: "host_baselines",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_host_baselines_query(find_query_test_host_group(t, "customers"), statistics, window)
+			},
+		},
+		{
+			name: "total_hostgroup_summed",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_baseline_query(find_query_test_host_group(t, "uplink"), statistics, window, nil)
+			},
+		},
+		{
+			name:                    "total_hostgroup_metrics_table",
+			hostgroup_metrics_table: "hostgroup_metrics",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_baseline_query(find_query_test_host_group(t, "uplink"), statistics, window, nil)
+			},
+		},
+		{
+			name: "longest_prefix_overlap",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_baseline_query(find_query_test_host_group(t, "vip_hosts"), statistics, window, nil)
+			},
+		},
+		{
+			name: "global_hostgroup",
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_baseline_query(find_query_test_host_group(t, "everything_else"), statistics, window, nil)
+			},
+		},
+		{
+			name:                    "external_table",
+			network_table_threshold: 1,
+			generate: func(t *testing.T, statistics []*traffic_statistic, window calculation_window) built_query {
+				return generate_baseline_query(find_query_test_host_group(t, "customers"), statistics, window, nil)
+			},
+		},
+	}
+
+	for _, test_case := range test_cases {
+		t.Run(test_case.name, func(t *testing.T) {
+			network_table_threshold := test_case.network_table_threshold
+
+			if network_table_threshold == 0 {
+				network_table_threshold = 1000
+			}
+
+			window := setup_query_builder_test(t, network_table_threshold, test_case.hostgroup_metrics_table)
+
+			statistics, err := configured_statistics()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			query := test_case.generate(t, statistics, window)
+
+			check_query_arguments(t, query)
+
+			golden_path := filepath.Join("testdata", test_case.name+".golden")
+			formatted_query := format_golden_query(query)
+
+			if *update_golden_files {
+				if err := ioutil.WriteFile(golden_path, []byte(formatted_query), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			expected_query, err := ioutil.ReadFile(golden_path)
+
+			if err != nil {
+				t.Fatalf("Cannot read golden file, run go test -update to create it: %v", err)
+			}
+
+			if formatted_query != string(expected_query) {
+				t.Errorf("Query differs from %s, run go test -update after intended change\ngot:\n%s\nexpected:\n%s", golden_path, formatted_query, expected_query)
+			}
+		})
+	}
+}
+
+func TestQueryArgumentsAreNotShared(t *testing.T) {
+	window := setup_query_builder_test(t, 1000, "")
+
+	first_query := generate_top_talkers_query("customers", []string{"10.10.0.0/16"}, 10, window, []string{"packets_incoming"})
+
+	// Queries for other hostgroups and next cycles must not change arguments of query which we already built
+	maintenance_calendar = nil
+	hostgroup_where_clauses = calculate_hostgroup_where_clauses(query_test_host_groups[1:])
+	generate_top_talkers_query("vip_hosts", []string{"10.10.5.0/24"}, 10, window, []string{"packets_incoming"})
+
+	check_query_arguments(t, first_query)
+
+	if first_query.inlined() == first_query.sql {
+		t.Errorf("We have no bound parameters in query: %s", first_query.sql)
+	}
+
+	if !strings.Contains(first_query.inlined(), "toIPv4('10.10.0.0')") {
+		t.Errorf("Explain must show bound parameters as literals: %s", first_query.inlined())
+	}
+}
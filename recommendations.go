@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// MongoDB collection where we keep recommended FastNetMon thresholds
+const hostgroups_recommendations_collection_name = "baseline_exporter_hostgroups_recommendations"
+
+// Rule which translates baseline statistic into FastNetMon threshold
+type ThresholdRule struct {
+	// Name of FastNetMon hostgroup option, e.g. threshold_mbps
+	Threshold string `json:"threshold"`
+
+	// Metric and direction from baseline: bits, packets, flows, tcp_bits, tcp_syn_packets and so on
+	Metric    string `json:"metric"`
+	Direction string `json:"direction"`
+
+	// Statistic from baseline, it must be calculated
+	Statistic string `json:"statistic"`
+
+	Multiplier float64 `json:"multiplier"`
+
+	// Minimum value of threshold in threshold units
+	Floor int64 `json:"floor"`
+
+	// We round threshold up to multiple of this value, zero or one disables rounding
+	RoundTo int64 `json:"round_to"`
+}
+
+// Explains how we calculated recommended threshold
+type RecommendationReasoning struct {
+	Metric         string  `bson:"metric" json:"metric"`
+	Direction      string  `bson:"direction" json:"direction"`
+	Statistic      string  `bson:"statistic" json:"statistic"`
+	StatisticValue int64   `bson:"statistic_value" json:"statistic_value"`
+	Multiplier     float64 `bson:"multiplier" json:"multiplier"`
+	Floor          int64   `bson:"floor" json:"floor"`
+	RoundTo        int64   `bson:"round_to" json:"round_to"`
+	FloorApplied   bool    `bson:"floor_applied" json:"floor_applied"`
+}
+
+// Recommended value for single FastNetMon threshold
+type ThresholdRecommendation struct {
+	Threshold string                  `bson:"threshold" json:"threshold"`
+	Value     int64                   `bson:"value" json:"value"`
+	Unit      string                  `bson:"unit" json:"unit"`
+	Reasoning RecommendationReasoning `bson:"reasoning" json:"reasoning"`
+}
+
+// Structure to store recommended thresholds for hostgroup in MongoDB
+type RecommendationsStructure struct {
+	Name       string                    `bson:"name" json:"name"`
+	Thresholds []ThresholdRecommendation `bson:"thresholds" json:"thresholds"`
+	Metadata   CalculationMetadata       `bson:"metadata" json:"metadata"`
+}
+
+// Returns recommendation for threshold or nil when we do not have it
+func (recommendations *RecommendationsStructure) recommendation_for(threshold string) *ThresholdRecommendation {
+	for index := range recommendations.Thresholds {
+		if recommendations.Thresholds[index].Threshold == threshold {
+			return &recommendations.Thresholds[index]
+		}
+	}
+
+	return nil
+}
+
+// Returns rules for all FastNetMon thresholds in both directions
+// FastNetMon uses _outgoing suffix for thresholds of outgoing traffic
+func default_threshold_rules() []ThresholdRule {
+	rules := []ThresholdRule{}
+
+	thresholds := []struct {
+		name   string
+		metric string
+	}{
+		{"threshold_mbps", "bits"},
+		{"threshold_pps", "packets"},
+		{"threshold_flows", "flows"},
+		{"threshold_tcp_mbps", "tcp_bits"},
+		{"threshold_udp_mbps", "udp_bits"},
+		{"threshold_icmp_mbps", "icmp_bits"},
+		{"threshold_tcp_pps", "tcp_packets"},
+		{"threshold_udp_pps", "udp_packets"},
+		{"threshold_icmp_pps", "icmp_packets"},
+		{"threshold_tcp_syn_mbps", "tcp_syn_bits"},
+		{"threshold_tcp_syn_pps", "tcp_syn_packets"},
+	}
+
+	for _, direction := range []string{"incoming", "outgoing"} {
+		for _, threshold := range thresholds {
+			rule := ThresholdRule{Threshold: threshold.name, Metric: threshold.metric, Direction: direction, Statistic: "p95", Multiplier: 2}
+
+			if direction == "outgoing" {
+				rule.Threshold += "_outgoing"
+			}
+
+			switch threshold_unit(threshold.metric) {
+			case "mbps":
+				rule.Floor = 10
+				rule.RoundTo = 10
+			case "pps":
+				rule.Floor = 1000
+				rule.RoundTo = 1000
+			default:
+				rule.Floor = 100
+				rule.RoundTo = 100
+			}
+
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+// Returns unit of FastNetMon threshold for baseline metric
+func threshold_unit(metric string) string {
+	if strings.HasSuffix(metric, "bits") {
+		return "mbps"
+	}
+
+	if strings.HasSuffix(metric, "packets") {
+		return "pps"
+	}
+
+	return "flows"
+}
+
+// Checks threshold rule from configuration
+func validate_threshold_rule(rule ThresholdRule) error {
+	if rule.Threshold == "" {
+		return fmt.Errorf("threshold rule without threshold name")
+	}
+
+	if rule.Direction != "incoming" && rule.Direction != "outgoing" {
+		return fmt.Errorf("threshold rule %s has unknown direction %s", rule.Threshold, rule.Direction)
+	}
+
+	if (&TrafficBaseline{}).value_by_metric(rule.Metric) == nil {
+		return fmt.Errorf("threshold rule %s has unknown metric %s", rule.Threshold, rule.Metric)
+	}
+
+	if find_statistic(rule.Statistic) == nil {
+		return fmt.Errorf("threshold rule %s has unknown statistic %s", rule.Threshold, rule.Statistic)
+	}
+
+	if rule.Multiplier <= 0 {
+		return fmt.Errorf("threshold rule %s must have positive multiplier", rule.Threshold)
+	}
+
+	if rule.Floor < 0 || rule.RoundTo < 0 {
+		return fmt.Errorf("threshold rule %s must have non negative floor and round_to", rule.Threshold)
+	}
+
+	return nil
+}
+
+// Checks that all threshold rules are valid and use statistics which we calculate
+func validate_threshold_rules(statistics []*traffic_statistic) []string {
+	problems := []string{}
+
+	for _, rule := range configuration.ThresholdRules {
+		if err := validate_threshold_rule(rule); err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		calculated := false
+
+		for _, statistic := range statistics {
+			if statistic.name == rule.Statistic {
+				calculated = true
+			}
+		}
+
+		if !calculated {
+			problems = append(problems, fmt.Sprintf("threshold rule %s uses statistic %s which is not in statistics list", rule.Threshold, rule.Statistic))
+		}
+	}
+
+	return problems
+}
+
+// Calculates recommended threshold from baseline according to rule
+func recommend_threshold(baseline *BaselineStructure, rule ThresholdRule) (*ThresholdRecommendation, error) {
+	traffic_baseline := &baseline.Incoming
+
+	if rule.Direction == "outgoing" {
+		traffic_baseline = &baseline.Outgoing
+	}
+
+	traffic_value := traffic_baseline.value_by_metric(rule.Metric)
+	statistic := find_statistic(rule.Statistic)
+
+	if traffic_value == nil || statistic == nil {
+		return nil, fmt.Errorf("Cannot find %s of %s %s", rule.Statistic, rule.Direction, rule.Metric)
+	}
+
+	statistic_value, ok := statistic.get(traffic_value)
+
+	if !ok {
+		return nil, fmt.Errorf("We have no %s for %s %s in baseline", rule.Statistic, rule.Direction, rule.Metric)
+	}
+
+	unit := threshold_unit(rule.Metric)
+
+	value := float64(statistic_value) * rule.Multiplier
+
+	// Baselines keep bits per second but FastNetMon uses megabits
+	if unit == "mbps" {
+		value = value / 1000000
+	}
+
+	rounded_value := int64(math.Ceil(value))
+
+	if rule.RoundTo > 1 && rounded_value%rule.RoundTo != 0 {
+		rounded_value = (rounded_value/rule.RoundTo + 1) * rule.RoundTo
+	}
+
+	recommendation := &ThresholdRecommendation{
+		Threshold: rule.Threshold,
+		Value:     rounded_value,
+		Unit:      unit,
+		Reasoning: RecommendationReasoning{
+			Metric:         rule.Metric,
+			Direction:      rule.Direction,
+			Statistic:      rule.Statistic,
+			StatisticValue: statistic_value,
+			Multiplier:     rule.Multiplier,
+			Floor:          rule.Floor,
+			RoundTo:        rule.RoundTo,
+		},
+	}
+
+	if recommendation.Value < rule.Floor {
+		recommendation.Value = rule.Floor
+		recommendation.Reasoning.FloorApplied = true
+	}
+
+	return recommendation, nil
+}
+
+// Generates recommended thresholds for hostgroup from its baseline
+func generate_recommendations(baseline *BaselineStructure) (*RecommendationsStructure, error) {
+	recommendations := &RecommendationsStructure{
+		Name:       baseline.Name,
+		Thresholds: []ThresholdRecommendation{},
+		Metadata:   baseline.Metadata,
+	}
+
+	recommendations.Metadata.ComputedAt = time.Now()
+
+	for _, rule := range configuration.ThresholdRules {
+		recommendation, err := recommend_threshold(baseline, rule)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot calculate %s: %w", rule.Threshold, err)
+		}
+
+		recommendations.Thresholds = append(recommendations.Thresholds, *recommendation)
+	}
+
+	return recommendations, nil
+}
+
+// Generates recommendations from baseline and stores them in storage or adds them to dry run
+func export_recommendations(ctx context.Context, storage storage_backend, baseline *BaselineStructure, dry_run *dry_run_report, report *RunReport) {
+	recommendations, err := generate_recommendations(baseline)
+
+	if err != nil {
+		report.add_error(baseline.Name, "Cannot generate threshold recommendations: %v", err)
+		return
+	}
+
+	if dry_run != nil {
+		err = dry_run.add_recommendations(ctx, storage, recommendations)
+
+		if err != nil {
+			report.add_error(baseline.Name, "Cannot compare threshold recommendations with %s: %v", storage.description(), err)
+		}
+
+		return
+	}
+
+	err = retry_transient(ctx, "Threshold recommendations update for "+baseline.Name, func() error {
+		return storage.write_document(ctx, hostgroups_recommendations_collection_name, baseline.Name, recommendations)
+	})
+
+	if err != nil {
+		report.add_error(baseline.Name, "Cannot update threshold recommendations in %s: %v", storage.description(), err)
+		return
+	}
+
+	fast_logger.Printf("Updated threshold recommendations in %s for %s", storage.description(), baseline.Name)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRecommendThreshold(t *testing.T) {
+	int64_pointer := func(value int64) *int64 {
+		return &value
+	}
+
+	test_cases := []struct {
+		name          string
+		incoming      TrafficBaseline
+		outgoing      TrafficBaseline
+		rule          ThresholdRule
+		value         int64
+		floor_applied bool
+	}{
+		{
+			name:          "zero baseline gets floor",
+			rule:          ThresholdRule{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 10, RoundTo: 10},
+			value:         10,
+			floor_applied: true,
+		},
+		{
+			name:     "megabits are rounded up to multiple",
+			incoming: TrafficBaseline{Bits: TrafficValue{Quantile95: 3000000}},
+			rule:     ThresholdRule{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 10, RoundTo: 10},
+			value:    10,
+		},
+		{
+			name:          "value below floor without rounding",
+			incoming:      TrafficBaseline{Bits: TrafficValue{Quantile95: 3000000}},
+			rule:          ThresholdRule{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 10, RoundTo: 1},
+			value:         10,
+			floor_applied: true,
+		},
+		{
+			name:     "value equal to floor",
+			incoming: TrafficBaseline{Packets: TrafficValue{Quantile95: 500}},
+			rule:     ThresholdRule{Threshold: "threshold_pps", Metric: "packets", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 1000, RoundTo: 1000},
+			value:    1000,
+		},
+		{
+			name:     "exact multiple is not rounded",
+			incoming: TrafficBaseline{Bits: TrafficValue{Quantile95: 10000000}},
+			rule:     ThresholdRule{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 10, RoundTo: 10},
+			value:    20,
+		},
+		{
+			name:     "one bit above multiple goes to next multiple",
+			incoming: TrafficBaseline{Bits: TrafficValue{Quantile95: 20000001}},
+			rule:     ThresholdRule{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p95", Multiplier: 1, Floor: 10, RoundTo: 10},
+			value:    30,
+		},
+		{
+			name:     "one packet above multiple goes to next multiple",
+			incoming: TrafficBaseline{Packets: TrafficValue{Quantile95: 501}},
+			rule:     ThresholdRule{Threshold: "threshold_pps", Metric: "packets", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 1000, RoundTo: 1000},
+			value:    2000,
+		},
+		{
+			name:     "zero round_to disables rounding",
+			incoming: TrafficBaseline{Packets: TrafficValue{Quantile95: 501}},
+			rule:     ThresholdRule{Threshold: "threshold_pps", Metric: "packets", Direction: "incoming", Statistic: "p95", Multiplier: 2, Floor: 1000},
+			value:    1002,
+		},
+		{
+			name:     "fraction is rounded up",
+			incoming: TrafficBaseline{Flows: TrafficValue{Quantile95: 333}},
+			rule:     ThresholdRule{Threshold: "threshold_flows", Metric: "flows", Direction: "incoming", Statistic: "p95", Multiplier: 1.5, Floor: 100, RoundTo: 1},
+			value:    500,
+		},
+		{
+			name:     "optional statistic of outgoing traffic",
+			incoming: TrafficBaseline{Tcp_syn_packets: TrafficValue{Quantile99: int64_pointer(100000)}},
+			outgoing: TrafficBaseline{Tcp_syn_packets: TrafficValue{Quantile99: int64_pointer(2500)}},
+			rule:     ThresholdRule{Threshold: "threshold_tcp_syn_pps_outgoing", Metric: "tcp_syn_packets", Direction: "outgoing", Statistic: "p99", Multiplier: 2, Floor: 1000, RoundTo: 1000},
+			value:    5000,
+		},
+	}
+
+	for _, test_case := range test_cases {
+		baseline := &BaselineStructure{Name: "customers", Incoming: test_case.incoming, Outgoing: test_case.outgoing}
+
+		recommendation, err := recommend_threshold(baseline, test_case.rule)
+
+		if err != nil {
+			t.Errorf("%s: %v", test_case.name, err)
+			continue
+		}
+
+		if recommendation.Value != test_case.value || recommendation.Reasoning.FloorApplied != test_case.floor_applied {
+			t.Errorf("%s: expected %d with floor applied %t, we have %d with floor applied %t",
+				test_case.name, test_case.value, test_case.floor_applied, recommendation.Value, recommendation.Reasoning.FloorApplied)
+		}
+
+		if recommendation.Threshold != test_case.rule.Threshold || recommendation.Unit != threshold_unit(test_case.rule.Metric) {
+			t.Errorf("%s: wrong threshold or unit in %+v", test_case.name, recommendation)
+		}
+	}
+}
+
+func TestRecommendThresholdMissingBaseline(t *testing.T) {
+	baseline := &BaselineStructure{Name: "customers", Incoming: TrafficBaseline{Bits: TrafficValue{Quantile95: 1000000}}}
+
+	rules := []ThresholdRule{
+		// p99 is optional and baseline was calculated without it
+		{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p99", Multiplier: 2},
+		{Threshold: "threshold_mbps", Metric: "bytes", Direction: "incoming", Statistic: "p95", Multiplier: 2},
+		{Threshold: "threshold_mbps", Metric: "bits", Direction: "incoming", Statistic: "p42", Multiplier: 2},
+	}
+
+	for _, rule := range rules {
+		if recommendation, err := recommend_threshold(baseline, rule); err == nil {
+			t.Errorf("Rule %+v must fail without baseline value, we have %+v", rule, recommendation)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Clickhouse error codes which can disappear when we repeat query
+var transient_clickhouse_error_codes = map[int32]bool{
+	3:   true, // UNEXPECTED_END_OF_FILE
+	202: true, // TOO_MANY_SIMULTANEOUS_QUERIES
+	209: true, // SOCKET_TIMEOUT
+	210: true, // NETWORK_ERROR
+	425: true, // SYSTEM_ERROR
+}
+
+// Returns true when error can disappear on next attempt
+// We never retry cancelled or timed out queries because they took all allowed time
+func is_transient_error(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var clickhouse_exception *clickhouse.Exception
+
+	if errors.As(err, &clickhouse_exception) {
+		return transient_clickhouse_error_codes[clickhouse_exception.Code]
+	}
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+
+	var network_error net.Error
+
+	if errors.As(err, &network_error) {
+		return true
+	}
+
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE)
+}
+
+// Calls operation until it succeeds, fails with non transient error or we run out of retries
+// Delay between attempts starts from retry_delay and doubles after every attempt up to retry_max_delay
+func retry_transient(ctx context.Context, description string, operation func() error) error {
+	delay := time.Duration(configuration.RetryDelay) * time.Millisecond
+	max_delay := time.Duration(configuration.RetryMaxDelay) * time.Millisecond
+
+	for attempt := int64(1); ; attempt++ {
+		err := operation()
+
+		if err == nil || attempt > configuration.Retries || !is_transient_error(err) || ctx.Err() != nil {
+			return err
+		}
+
+		fast_logger.Printf("%s failed with transient error, retry %d of %d in %s: %v", description, attempt, configuration.Retries, delay, err)
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+
+		delay *= 2
+
+		if delay > max_delay {
+			delay = max_delay
+		}
+	}
+}
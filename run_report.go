@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoDB collection where we keep reports about export runs
+const run_reports_collection_name = "baseline_exporter_run_reports"
+
+// Problems which we found in hostgroup during run
+type HostgroupRunReport struct {
+	Name string `bson:"name" json:"name"`
+
+	// Networks which we cannot parse with error
+	InvalidNetworks []string `bson:"invalid_networks,omitempty" json:"invalid_networks,omitempty"`
+
+	// Networks with host bits which we replaced by canonical form
+	NormalisedNetworks []string `bson:"normalised_networks,omitempty" json:"normalised_networks,omitempty"`
+
+	// We do not calculate anything for hostgroup when all its networks are invalid
+	Refused bool `bson:"refused" json:"refused"`
+
+	// Results which we could not calculate or store
+	Errors []string `bson:"errors,omitempty" json:"errors,omitempty"`
+}
+
+// Final status of run
+const (
+	run_status_success = "success"
+
+	// Some results are missing, details are in errors of hostgroups
+	run_status_partial = "partial"
+
+	// We could not process hostgroups at all
+	run_status_failed = "failed"
+
+	// Run was stopped by signal
+	run_status_interrupted = "interrupted"
+)
+
+// Report about single export run
+type RunReport struct {
+	StartedAt       time.Time             `bson:"started_at" json:"started_at"`
+	FinishedAt      time.Time             `bson:"finished_at" json:"finished_at"`
+	ExporterVersion string                `bson:"exporter_version" json:"exporter_version"`
+	DryRun          bool                  `bson:"dry_run" json:"dry_run"`
+	Status          string                `bson:"status" json:"status"`
+	Error           string                `bson:"error,omitempty" json:"error,omitempty"`
+	Hostgroups      []*HostgroupRunReport `bson:"hostgroups" json:"hostgroups"`
+
+	// Workers add problems in parallel
+	mutex sync.Mutex
+}
+
+// Creates report for run which starts now
+func new_run_report(dry_run bool) *RunReport {
+	return &RunReport{StartedAt: time.Now(), ExporterVersion: exporter_version, DryRun: dry_run, Hostgroups: []*HostgroupRunReport{}}
+}
+
+// Returns report for hostgroup and creates it when we do not have it yet
+func (report *RunReport) hostgroup(hostgroup_name string) *HostgroupRunReport {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	return report.hostgroup_locked(hostgroup_name)
+}
+
+// Logs problem with hostgroup and adds it to report
+func (report *RunReport) add_error(hostgroup_name string, format string, arguments ...interface{}) {
+	message := fmt.Sprintf(format, arguments...)
+
+	fast_logger.Printf("%s: %s", hostgroup_name, message)
+
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	hostgroup_report := report.hostgroup_locked(hostgroup_name)
+	hostgroup_report.Errors = append(hostgroup_report.Errors, message)
+}
+
+// Returns true when some results of hostgroups are missing
+func (report *RunReport) has_errors() bool {
+	report.mutex.Lock()
+	defer report.mutex.Unlock()
+
+	for _, hostgroup_report := range report.Hostgroups {
+		if len(hostgroup_report.Errors) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sets final status of run from error which stopped it
+func (report *RunReport) finish(err error, stop_requested bool) {
+	report.FinishedAt = time.Now()
+
+	switch {
+	case err != nil && stop_requested:
+		report.Status = run_status_interrupted
+	case err != nil:
+		report.Status = run_status_failed
+	case report.has_errors():
+		report.Status = run_status_partial
+	default:
+		report.Status = run_status_success
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+	}
+}
+
+// Returns exit code for run status
+func (report *RunReport) exit_code() int {
+	switch report.Status {
+	case run_status_success:
+		return 0
+	case run_status_partial:
+		return 3
+	default:
+		return 1
+	}
+}
+
+// Must be called with locked mutex
+func (report *RunReport) hostgroup_locked(hostgroup_name string) *HostgroupRunReport {
+	for _, hostgroup_report := range report.Hostgroups {
+		if hostgroup_report.Name == hostgroup_name {
+			return hostgroup_report
+		}
+	}
+
+	hostgroup_report := &HostgroupRunReport{Name: hostgroup_name}
+	report.Hostgroups = append(report.Hostgroups, hostgroup_report)
+
+	return hostgroup_report
+}
+
+// Replaces networks of hostgroup by canonical ones and returns problems which we found
+// Network like 10.0.0.1/24 becomes 10.0.0.0/24
+func normalise_hostgroup_networks(host_group *Ban_settings_t) (invalid_networks []string, normalised_networks []string) {
+	valid_networks := []string{}
+
+	for _, network_string := range host_group.Networks {
+		_, network, err := net.ParseCIDR(network_string)
+
+		if err != nil {
+			invalid_networks = append(invalid_networks, fmt.Sprintf("%s: %v", network_string, err))
+			continue
+		}
+
+		if network.String() != network_string {
+			normalised_networks = append(normalised_networks, fmt.Sprintf("%s -> %s", network_string, network.String()))
+		}
+
+		valid_networks = append(valid_networks, network.String())
+	}
+
+	host_group.Networks = valid_networks
+
+	return invalid_networks, normalised_networks
+}
+
+// Validates networks of all hostgroups and returns only hostgroups which we can use
+// Hostgroups which lost all networks because of errors are refused, we must not treat them as global
+// report can be nil when we do not need report
+func validate_hostgroups_networks(host_groups []Ban_settings_t, report *RunReport) []Ban_settings_t {
+	valid_host_groups := []Ban_settings_t{}
+
+	for _, host_group := range host_groups {
+		invalid_networks, normalised_networks := normalise_hostgroup_networks(&host_group)
+
+		for _, invalid_network := range invalid_networks {
+			fast_logger.Printf("Hostgroup %s has invalid network %s", host_group.Name, invalid_network)
+		}
+
+		for _, normalised_network := range normalised_networks {
+			fast_logger.Printf("Hostgroup %s has non canonical network, we use %s", host_group.Name, normalised_network)
+		}
+
+		refused := len(invalid_networks) > 0 && len(host_group.Networks) == 0
+
+		if report != nil && (len(invalid_networks) > 0 || len(normalised_networks) > 0) {
+			hostgroup_report := report.hostgroup(host_group.Name)
+
+			hostgroup_report.InvalidNetworks = invalid_networks
+			hostgroup_report.NormalisedNetworks = normalised_networks
+			hostgroup_report.Refused = refused
+		}
+
+		if refused {
+			// We have no results for this hostgroup and run must become partial
+			if report != nil {
+				report.add_error(host_group.Name, "Cannot calculate anything because all networks are invalid, we skip hostgroup")
+			} else {
+				fast_logger.Printf("Hostgroup %s has no valid networks, we skip it", host_group.Name)
+			}
+
+			continue
+		}
+
+		valid_host_groups = append(valid_host_groups, host_group)
+	}
+
+	return valid_host_groups
+}
+
+// Stores run report in MongoDB or as document named by start time in other storage backends
+func store_run_report(ctx context.Context, storage storage_backend, report *RunReport) error {
+	mongo_client := storage.mongodb_client()
+
+	if mongo_client == nil {
+		return storage.write_document(ctx, run_reports_collection_name, report.StartedAt.UTC().Format("20060102T150405Z"), report)
+	}
+
+	reports_collection := mongo_client.Database(global_db_conf.Db_name).Collection(run_reports_collection_name)
+
+	_, err := reports_collection.InsertOne(ctx, report)
+
+	return err
+}
+
+// Prints latest run report from MongoDB
+func show_run_report_command(arguments []string) int {
+	flag_set := new_command_flag_set("show-run-report", "")
+	flag_set.Parse(arguments)
+
+	ensure_root_rights()
+
+	log_file := setup_logging(os.Stderr)
+	defer log_file.Close()
+
+	ctx, cancel := command_context()
+	defer cancel()
+
+	mongo_client := prepare_mongodb_connection(ctx)
+	defer disconnect_from_mongodb(mongo_client)
+
+	reports_collection := mongo_client.Database(global_db_conf.Db_name).Collection(run_reports_collection_name)
+
+	report := &RunReport{}
+
+	err := reports_collection.FindOne(ctx, bson.D{}, options.FindOne().SetSort(bson.D{{Key: "started_at", Value: -1}})).Decode(report)
+
+	if err == mongo.ErrNoDocuments {
+		fast_logger.Printf("We have no run reports")
+		return 1
+	}
+
+	if err != nil {
+		fast_logger.Printf("Cannot read run report: %v", err)
+		return 1
+	}
+
+	return print_json(report)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRefusedHostgroupMakesRunPartial(t *testing.T) {
+	report := new_run_report(false)
+
+	host_groups := []Ban_settings_t{
+		{Name: "broken", Networks: []string{"10.0.0.0/33", "not a network"}},
+		{Name: "customers", Networks: []string{"10.10.0.1/16"}},
+		{Name: "global"},
+	}
+
+	valid_host_groups := validate_hostgroups_networks(host_groups, report)
+
+	if len(valid_host_groups) != 2 || valid_host_groups[0].Name != "customers" || valid_host_groups[1].Name != "global" {
+		t.Fatalf("We must skip only hostgroup with all networks invalid, we have %+v", valid_host_groups)
+	}
+
+	hostgroup_report := report.hostgroup("broken")
+
+	if !hostgroup_report.Refused || len(hostgroup_report.Errors) != 1 || len(hostgroup_report.InvalidNetworks) != 2 {
+		t.Errorf("Refused hostgroup must have invalid networks and error in report, we have %+v", hostgroup_report)
+	}
+
+	report.finish(nil, false)
+
+	if report.Status != run_status_partial || report.exit_code() != 3 {
+		t.Errorf("Run with refused hostgroup must be partial with exit code 3, we have %s and %d", report.Status, report.exit_code())
+	}
+}
+
+func TestNormalisedNetworksKeepRunSuccessful(t *testing.T) {
+	report := new_run_report(false)
+
+	validate_hostgroups_networks([]Ban_settings_t{{Name: "customers", Networks: []string{"10.10.0.1/16", "not a network"}}}, report)
+
+	report.finish(nil, false)
+
+	if report.Status != run_status_success || report.exit_code() != 0 {
+		t.Errorf("Hostgroup with some valid networks must not change status, we have %s and %d", report.Status, report.exit_code())
+	}
+}
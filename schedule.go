@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed cron expression in classic five field format: minute hour day_of_month month day_of_week
+type cron_schedule struct {
+	minutes       [60]bool
+	hours         [24]bool
+	days_of_month [32]bool
+	months        [13]bool
+	days_of_week  [7]bool
+
+	// We need them to implement classic cron logic when both day fields are restricted
+	any_day_of_month bool
+	any_day_of_week  bool
+}
+
+// Shortcuts supported by most cron implementations
+var cron_schedule_macros = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// Parses cron expression like "*/15 * * * *" or "0 3 * * 1-5"
+func parse_cron_schedule(expression string) (*cron_schedule, error) {
+	expression = strings.TrimSpace(expression)
+
+	if macro, ok := cron_schedule_macros[expression]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields but we have %d", len(fields))
+	}
+
+	schedule := &cron_schedule{}
+
+	if err := parse_cron_field(fields[0], 0, 59, schedule.minutes[:]); err != nil {
+		return nil, fmt.Errorf("bad minute field: %w", err)
+	}
+
+	if err := parse_cron_field(fields[1], 0, 23, schedule.hours[:]); err != nil {
+		return nil, fmt.Errorf("bad hour field: %w", err)
+	}
+
+	if err := parse_cron_field(fields[2], 1, 31, schedule.days_of_month[:]); err != nil {
+		return nil, fmt.Errorf("bad day of month field: %w", err)
+	}
+
+	if err := parse_cron_field(fields[3], 1, 12, schedule.months[:]); err != nil {
+		return nil, fmt.Errorf("bad month field: %w", err)
+	}
+
+	// Cron allows 7 as Sunday, we keep 8 elements here and fold it to 0 later
+	days_of_week := make([]bool, 8)
+
+	if err := parse_cron_field(fields[4], 0, 7, days_of_week); err != nil {
+		return nil, fmt.Errorf("bad day of week field: %w", err)
+	}
+
+	copy(schedule.days_of_week[:], days_of_week[:7])
+
+	if days_of_week[7] {
+		schedule.days_of_week[0] = true
+	}
+
+	// Field like */1 or 0-7 is unrestricted too, we check parsed values instead of text
+	schedule.any_day_of_month = is_full_cron_range(schedule.days_of_month[:], 1, 31)
+	schedule.any_day_of_week = is_full_cron_range(schedule.days_of_week[:], 0, 6)
+
+	return schedule, nil
+}
+
+// Returns true when field allows all values from range
+func is_full_cron_range(allowed []bool, min_value int, max_value int) bool {
+	for value := min_value; value <= max_value; value++ {
+		if !allowed[value] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Parses single field of cron expression: *, */step, value, range, range/step and comma separated lists of them
+func parse_cron_field(field string, min_value int, max_value int, allowed []bool) error {
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+
+		if slash_position := strings.Index(part, "/"); slash_position != -1 {
+			parsed_step, err := strconv.Atoi(part[slash_position+1:])
+
+			if err != nil || parsed_step <= 0 {
+				return fmt.Errorf("bad step in '%s'", part)
+			}
+
+			step = parsed_step
+			part = part[:slash_position]
+		}
+
+		range_start := min_value
+		range_end := max_value
+
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			parsed_start, err := strconv.Atoi(bounds[0])
+
+			if err != nil {
+				return fmt.Errorf("bad value '%s'", bounds[0])
+			}
+
+			range_start = parsed_start
+			range_end = parsed_start
+
+			if len(bounds) == 2 {
+				parsed_end, err := strconv.Atoi(bounds[1])
+
+				if err != nil {
+					return fmt.Errorf("bad value '%s'", bounds[1])
+				}
+
+				range_end = parsed_end
+			} else if step != 1 {
+				// "5/10" means from 5 till the end with step 10
+				range_end = max_value
+			}
+		}
+
+		if range_start < min_value || range_end > max_value || range_start > range_end {
+			return fmt.Errorf("'%s' is out of range %d-%d", part, min_value, max_value)
+		}
+
+		for value := range_start; value <= range_end; value += step {
+			allowed[value] = true
+		}
+	}
+
+	return nil
+}
+
+// Returns true when day matches day of month and day of week fields
+func (schedule *cron_schedule) day_matches(moment time.Time) bool {
+	day_of_month_matches := schedule.days_of_month[moment.Day()]
+	day_of_week_matches := schedule.days_of_week[int(moment.Weekday())]
+
+	// When both fields are restricted cron runs job when any of them matches
+	if !schedule.any_day_of_month && !schedule.any_day_of_week {
+		return day_of_month_matches || day_of_week_matches
+	}
+
+	return day_of_month_matches && day_of_week_matches
+}
+
+// Returns first moment strictly after specified time which matches schedule
+// We search in wall clock time of location and every matching wall clock time runs once:
+// times skipped when clock goes forward run right after the change and repeated times run at first occurrence
+func (schedule *cron_schedule) next(after time.Time) time.Time {
+	wall_clock_after := wall_clock_time(after)
+
+	for {
+		wall_clock, ok := schedule.next_wall_clock_time(wall_clock_after)
+
+		if !ok {
+			// Expression like "0 0 31 2 *" never matches, let's retry in a day instead of spinning
+			return after.Add(24 * time.Hour)
+		}
+
+		moment := wall_clock_moment(wall_clock, after.Location())
+
+		// We already passed this wall clock time when clock went back
+		if !moment.After(after) {
+			wall_clock_after = wall_clock
+			continue
+		}
+
+		return moment
+	}
+}
+
+// Returns wall clock time of moment as time in UTC which has no DST changes
+func wall_clock_time(moment time.Time) time.Time {
+	return time.Date(moment.Year(), moment.Month(), moment.Day(), moment.Hour(), moment.Minute(), 0, 0, time.UTC)
+}
+
+// Returns moment of wall clock time in location
+// Time which does not exist because clock went forward is moved forward by size of change
+// Time which exists twice because clock went back is resolved to first occurrence
+func wall_clock_moment(wall_clock time.Time, location *time.Location) time.Time {
+	moment := time.Date(wall_clock.Year(), wall_clock.Month(), wall_clock.Day(), wall_clock.Hour(), wall_clock.Minute(), 0, 0, location)
+
+	_, offset := moment.Zone()
+
+	// DST changes are less than 3 hours and it gives us offset before change
+	_, previous_offset := moment.Add(-3 * time.Hour).Zone()
+
+	if previous_offset > offset {
+		first_occurrence := moment.Add(-time.Duration(previous_offset-offset) * time.Second)
+
+		if wall_clock_time(first_occurrence).Equal(wall_clock) {
+			return first_occurrence
+		}
+	}
+
+	return moment
+}
+
+// Returns first wall clock time strictly after specified one which matches schedule, both are in UTC
+func (schedule *cron_schedule) next_wall_clock_time(after time.Time) (time.Time, bool) {
+	moment := after.Truncate(time.Minute).Add(time.Minute)
+
+	// Every valid expression matches at least once in 5 years (29th of February is the worst case)
+	limit := moment.AddDate(5, 0, 0)
+
+	for moment.Before(limit) {
+		if !schedule.months[int(moment.Month())] {
+			moment = time.Date(moment.Year(), moment.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !schedule.day_matches(moment) {
+			moment = time.Date(moment.Year(), moment.Month(), moment.Day()+1, 0, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !schedule.hours[moment.Hour()] {
+			moment = time.Date(moment.Year(), moment.Month(), moment.Day(), moment.Hour()+1, 0, 0, 0, time.UTC)
+			continue
+		}
+
+		if !schedule.minutes[moment.Minute()] {
+			moment = moment.Add(time.Minute)
+			continue
+		}
+
+		return moment, true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronScheduleNext(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	utc := func(year int, month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(year, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	// Moment in London by UTC time, it's the only way to pick time which exists twice
+	london_at := func(year int, month time.Month, day int, hour int, minute int) time.Time {
+		return utc(year, month, day, hour, minute).In(london)
+	}
+
+	test_cases := []struct {
+		name       string
+		expression string
+		after      time.Time
+		expected   time.Time
+	}{
+		{"every 15 minutes", "*/15 * * * *", utc(2022, 4, 7, 10, 7), utc(2022, 4, 7, 10, 15)},
+		{"every 15 minutes at end of hour", "*/15 * * * *", utc(2022, 4, 7, 10, 45), utc(2022, 4, 7, 11, 0)},
+		{"strictly after matching time", "*/15 * * * *", time.Date(2022, 4, 7, 10, 15, 30, 0, time.UTC), utc(2022, 4, 7, 10, 30)},
+		{"hourly macro", "@hourly", utc(2022, 4, 7, 10, 0), utc(2022, 4, 7, 11, 0)},
+		{"range of days of week", "0 3 * * 1-5", utc(2022, 4, 8, 4, 0), utc(2022, 4, 11, 3, 0)},
+		{"lists", "0,30 9,17 * * *", utc(2022, 4, 7, 9, 30), utc(2022, 4, 7, 17, 0)},
+		{"range with step", "0 8-18/2 * * *", utc(2022, 4, 7, 10, 0), utc(2022, 4, 7, 12, 0)},
+		{"range with step till next day", "0 8-18/2 * * *", utc(2022, 4, 7, 18, 0), utc(2022, 4, 8, 8, 0)},
+		{"start with step", "5/20 * * * *", utc(2022, 4, 7, 10, 25), utc(2022, 4, 7, 10, 45)},
+		{"Sunday as 7", "0 0 * * 7", utc(2022, 4, 7, 12, 0), utc(2022, 4, 10, 0, 0)},
+		{"day of month or day of week matches Friday", "0 0 13 * 5", utc(2022, 4, 7, 12, 0), utc(2022, 4, 8, 0, 0)},
+		{"day of month or day of week matches 13th", "0 0 13 * 5", utc(2022, 4, 8, 0, 0), utc(2022, 4, 13, 0, 0)},
+		{"unrestricted day of week with step", "0 0 13 * */1", utc(2022, 4, 7, 12, 0), utc(2022, 4, 13, 0, 0)},
+		{"unrestricted day of week as range", "0 0 13 * 0-7", utc(2022, 4, 7, 12, 0), utc(2022, 4, 13, 0, 0)},
+		{"day of month with month", "0 0 13 6 *", utc(2022, 4, 7, 12, 0), utc(2022, 6, 13, 0, 0)},
+		{"month without 31st day", "0 0 31 * *", utc(2022, 4, 1, 0, 0), utc(2022, 5, 31, 0, 0)},
+		{"next year", "0 0 1 * *", utc(2022, 12, 15, 0, 0), utc(2023, 1, 1, 0, 0)},
+		{"last minute of year", "59 23 * * *", utc(2022, 12, 31, 23, 59), utc(2023, 1, 1, 23, 59)},
+		{"29th of February", "0 0 29 2 *", utc(2022, 3, 1, 0, 0), utc(2024, 2, 29, 0, 0)},
+		{"never matches", "0 0 31 2 *", utc(2022, 4, 7, 12, 0), utc(2022, 4, 8, 12, 0)},
+
+		// Clock goes from 01:00 GMT to 02:00 BST on 27th of March 2022
+		{"time skipped by DST runs after change", "30 1 * * *", london_at(2022, 3, 27, 0, 45), london_at(2022, 3, 27, 1, 30)},
+		{"day after skipped time", "30 1 * * *", london_at(2022, 3, 27, 1, 30), london_at(2022, 3, 28, 0, 30)},
+		{"hourly across skipped hour", "0 * * * *", london_at(2022, 3, 27, 0, 30), london_at(2022, 3, 27, 1, 0)},
+		{"hourly after skipped hour", "0 * * * *", london_at(2022, 3, 27, 1, 0), london_at(2022, 3, 27, 2, 0)},
+
+		// Clock goes from 02:00 BST to 01:00 GMT on 30th of October 2022
+		{"repeated time runs at first occurrence", "30 1 * * *", london_at(2022, 10, 29, 23, 45), london_at(2022, 10, 30, 0, 30)},
+		{"repeated time does not run twice", "30 1 * * *", london_at(2022, 10, 30, 0, 30), london_at(2022, 10, 31, 1, 30)},
+		{"every 30 minutes skips repeated hour", "*/30 * * * *", london_at(2022, 10, 30, 0, 30), london_at(2022, 10, 30, 2, 0)},
+		{"every 30 minutes inside repeated hour", "*/30 * * * *", london_at(2022, 10, 30, 1, 10), london_at(2022, 10, 30, 2, 0)},
+	}
+
+	for _, test_case := range test_cases {
+		schedule, err := parse_cron_schedule(test_case.expression)
+
+		if err != nil {
+			t.Errorf("%s: cannot parse %s: %v", test_case.name, test_case.expression, err)
+			continue
+		}
+
+		if next := schedule.next(test_case.after); !next.Equal(test_case.expected) {
+			t.Errorf("%s: %s after %s must run at %s, we have %s", test_case.name, test_case.expression, test_case.after, test_case.expected, next)
+		}
+	}
+}
+
+func TestParseCronScheduleErrors(t *testing.T) {
+	expressions := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+		"1-b * * * *",
+		"@yearly",
+	}
+
+	for _, expression := range expressions {
+		if _, err := parse_cron_schedule(expression); err == nil {
+			t.Errorf("Expression %q must be rejected", expression)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// MongoDB collection for baselines per day of week and hour of day
+const hostgroups_seasonal_baseline_collection_name = "baseline_exporter_hostgroups_seasonal_baseline"
+
+// Baseline for specific day of week and range of hours
+type SeasonalBaselineBucket struct {
+	// ISO day of week: 1 is Monday and 7 is Sunday
+	DayOfWeek int64 `bson:"day_of_week" json:"day_of_week"`
+
+	// First hour of bucket, bucket covers hours from hour_start to hour_start + bucket_hours - 1
+	HourStart int64 `bson:"hour_start" json:"hour_start"`
+
+	SampleCount   int64 `bson:"sample_count" json:"sample_count"`
+	DistinctHosts int64 `bson:"distinct_hosts" json:"distinct_hosts"`
+
+	Incoming TrafficBaseline `bson:"incoming" json:"incoming"`
+	Outgoing TrafficBaseline `bson:"outgoing" json:"outgoing"`
+}
+
+// Structure to store seasonal baseline in MongoDB
+type SeasonalBaselineStructure struct {
+	Name        string                   `bson:"name" json:"name"`
+	BucketHours int64                    `bson:"bucket_hours" json:"bucket_hours"`
+	Timezone    string                   `bson:"timezone" json:"timezone"`
+	Buckets     []SeasonalBaselineBucket `bson:"buckets" json:"buckets"`
+	Metadata    CalculationMetadata      `bson:"metadata" json:"metadata"`
+}
+
+// Returns bucket which covers specified moment or nil when we have no data for it
+func (seasonal_baseline *SeasonalBaselineStructure) bucket_for(moment time.Time) (*SeasonalBaselineBucket, error) {
+	location, err := time.LoadLocation(seasonal_baseline.Timezone)
+
+	if err != nil {
+		return nil, err
+	}
+
+	moment = moment.In(location)
+
+	day_of_week := int64(moment.Weekday())
+
+	// Go uses 0 for Sunday
+	if day_of_week == 0 {
+		day_of_week = 7
+	}
+
+	hour_start := int64(moment.Hour()) / seasonal_baseline.BucketHours * seasonal_baseline.BucketHours
+
+	for index := range seasonal_baseline.Buckets {
+		bucket := &seasonal_baseline.Buckets[index]
+
+		if bucket.DayOfWeek == day_of_week && bucket.HourStart == hour_start {
+			return bucket, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Checks seasonal baseline options from configuration
+func validate_seasonal_configuration() error {
+	if configuration.SeasonalBucketHours <= 0 || 24%configuration.SeasonalBucketHours != 0 {
+		return fmt.Errorf("seasonal_bucket_hours must divide 24, we have %d", configuration.SeasonalBucketHours)
+	}
+
+	// Clickhouse will use it as string literal
+	if strings.ContainsAny(configuration.SeasonalTimezone, "'\\") {
+		return fmt.Errorf("bad seasonal_timezone %s", configuration.SeasonalTimezone)
+	}
+
+	if _, err := time.LoadLocation(configuration.SeasonalTimezone); err != nil {
+		return fmt.Errorf("bad seasonal_timezone %s: %v", configuration.SeasonalTimezone, err)
+	}
+
+	return nil
+}
+
+// Generates SQL query which calculates baselines for all buckets
+// outlier_conditions can be nil when we do not reject outliers
+func generate_seasonal_baseline_query(host_group Ban_settings_t, statistics []*traffic_statistic, window calculation_window, outlier_conditions map[string]string) built_query {
+	source := generate_metrics_source(host_group, window)
+
+	fields_for_processing := processMap(traffic_metric_columns, func(value string) string {
+		return strings.Join(generate_statistics_expressions(value, statistics, outlier_conditions[value]), ",")
+	})
+
+	query := new_select_query()
+	local_time := query.bind(format_query("toTimeZone(metricDateTime, %s)", bind_query_parameter(configuration.SeasonalTimezone)))
+
+	return query.columns(fmt.Sprintf("toDayOfWeek(%s) AS day_of_week", local_time), fmt.Sprintf("intDiv(toHour(%s), %d) * %d AS hour_start", local_time, configuration.SeasonalBucketHours, configuration.SeasonalBucketHours),
+		"COUNT(*)", source.distinct_hosts).columns(fields_for_processing...).
+		from(source.table).where(source.where_clause).group("day_of_week", "hour_start").order("day_of_week", "hour_start").build()
+}
+
+// Generates baselines per day of week and hour of day for list of networks
+func generate_seasonal_baselines(ctx context.Context, host_group Ban_settings_t, clickhouse_client *sql.DB, statistics []*traffic_statistic, window calculation_window) (*SeasonalBaselineStructure, error) {
+	outlier_conditions, err := calculate_outlier_conditions(ctx, host_group, clickhouse_client, window)
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := generate_seasonal_baseline_query(host_group, statistics, window, outlier_conditions)
+
+	if configuration.LogLevel == "debug" {
+		fast_logger.Printf("SQL Query: %s\n", query.sql)
+	}
+
+	query_ctx, cancel := with_query_timeout(ctx)
+	defer cancel()
+
+	rows, err := clickhouse_client.QueryContext(query_ctx, query.sql, query.arguments()...)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot execute Clickhouse query '%s' with error: %w\n", query.sql, err)
+	}
+
+	defer rows.Close()
+
+	seasonal_baseline := &SeasonalBaselineStructure{
+		Name:        host_group.Name,
+		BucketHours: configuration.SeasonalBucketHours,
+		Timezone:    configuration.SeasonalTimezone,
+		Buckets:     []SeasonalBaselineBucket{},
+	}
+
+	for rows.Next() {
+		bucket_baseline := &BaselineStructure{}
+		bucket := SeasonalBaselineBucket{}
+
+		destinations := []interface{}{&bucket.DayOfWeek, &bucket.HourStart, &bucket.SampleCount, &bucket.DistinctHosts}
+
+		column_destinations, apply := baseline_scan_destinations(bucket_baseline, statistics)
+
+		err := rows.Scan(append(destinations, column_destinations...)...)
+
+		if err != nil {
+			return nil, fmt.Errorf("Cannot read row: %v", err)
+		}
+
+		apply()
+
+		bucket.Incoming = bucket_baseline.Incoming
+		bucket.Outgoing = bucket_baseline.Outgoing
+
+		seasonal_baseline.Buckets = append(seasonal_baseline.Buckets, bucket)
+		seasonal_baseline.Metadata.SampleCount += bucket.SampleCount
+
+		// Same host can be present in many buckets and we cannot sum them, we keep lower bound instead
+		if bucket.DistinctHosts > seasonal_baseline.Metadata.DistinctHosts {
+			seasonal_baseline.Metadata.DistinctHosts = bucket.DistinctHosts
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read rows: %v", err)
+	}
+
+	if len(seasonal_baseline.Buckets) == 0 {
+		return nil, fmt.Errorf("There are no data in CLickhouse")
+	}
+
+	fill_calculation_metadata(&seasonal_baseline.Metadata, host_group.Name, host_group.Networks, window, statistics_aggregation_function(statistics))
+	seasonal_baseline.Metadata.CalculationMethod = host_group.Calculation_method
+	seasonal_baseline.Metadata.Statistics = statistic_names(statistics)
+	seasonal_baseline.Metadata.OutlierRejection = configuration.OutlierRejection
+
+	return seasonal_baseline, nil
+}
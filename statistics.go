@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Statistic which we can calculate for every traffic metric
+type traffic_statistic struct {
+	// Name in configuration file
+	name string
+
+	// Clickhouse aggregate function, we use quantile_level instead of it for quantiles
+	function string
+
+	// Level for quantiles, zero for other statistics
+	quantile_level float64
+
+	get func(value *TrafficValue) (int64, bool)
+	set func(value *TrafficValue, result int64)
+}
+
+// Returns true when we calculate this statistic with quantiles function
+func (statistic *traffic_statistic) is_quantile() bool {
+	return statistic.quantile_level > 0
+}
+
+// Generates getter and setter for optional field of TrafficValue
+func optional_traffic_value_field(field func(value *TrafficValue) **int64) (func(*TrafficValue) (int64, bool), func(*TrafficValue, int64)) {
+	get := func(value *TrafficValue) (int64, bool) {
+		if *field(value) == nil {
+			return 0, false
+		}
+
+		return **field(value), true
+	}
+
+	set := func(value *TrafficValue, result int64) {
+		*field(value) = &result
+	}
+
+	return get, set
+}
+
+// All statistics which we support
+var supported_statistics = []*traffic_statistic{}
+
+func init() {
+	add_statistic := func(name string, function string, quantile_level float64, field func(value *TrafficValue) **int64) {
+		get, set := optional_traffic_value_field(field)
+		supported_statistics = append(supported_statistics, &traffic_statistic{name: name, function: function, quantile_level: quantile_level, get: get, set: set})
+	}
+
+	add_statistic("p50", "", 0.5, func(value *TrafficValue) **int64 { return &value.Quantile50 })
+	add_statistic("p90", "", 0.9, func(value *TrafficValue) **int64 { return &value.Quantile90 })
+
+	// quantile_95 is mandatory field and we keep it as plain number for compatibility
+	supported_statistics = append(supported_statistics, &traffic_statistic{
+		name:           "p95",
+		quantile_level: 0.95,
+		get:            func(value *TrafficValue) (int64, bool) { return value.Quantile95, true },
+		set:            func(value *TrafficValue, result int64) { value.Quantile95 = result },
+	})
+
+	add_statistic("p99", "", 0.99, func(value *TrafficValue) **int64 { return &value.Quantile99 })
+	add_statistic("p99.9", "", 0.999, func(value *TrafficValue) **int64 { return &value.Quantile99_9 })
+	add_statistic("max", "max", 0, func(value *TrafficValue) **int64 { return &value.Max })
+	add_statistic("avg", "avg", 0, func(value *TrafficValue) **int64 { return &value.Avg })
+	add_statistic("stddev", "stddevPop", 0, func(value *TrafficValue) **int64 { return &value.Stddev })
+}
+
+// Returns statistic by name from configuration
+func find_statistic(name string) *traffic_statistic {
+	for _, statistic := range supported_statistics {
+		if statistic.name == name {
+			return statistic
+		}
+	}
+
+	return nil
+}
+
+// Matches old aggregation_function values like quantile(0.95), quantileExact(0.99) or quantileTDigest(0.9)
+var legacy_quantile_function = regexp.MustCompile(`^quantile[A-Za-z]*\(\s*([0-9.]+)\s*\)$`)
+
+// Returns statistic which replaces value of old aggregation_function option or nil when we have no such statistic
+// All quantile functions map to quantile statistic with same level because we calculate all quantiles by quantiles function
+func find_legacy_statistic(aggregation_function string) *traffic_statistic {
+	aggregation_function = strings.TrimSpace(aggregation_function)
+
+	quantile_level := 0.0
+
+	if aggregation_function == "median" {
+		quantile_level = 0.5
+	} else if match := legacy_quantile_function.FindStringSubmatch(aggregation_function); match != nil {
+		level, err := strconv.ParseFloat(match[1], 64)
+
+		if err != nil {
+			return nil
+		}
+
+		quantile_level = level
+	}
+
+	for _, statistic := range supported_statistics {
+		if quantile_level > 0 && statistic.quantile_level == quantile_level {
+			return statistic
+		}
+
+		if quantile_level == 0 && !statistic.is_quantile() && statistic.function == aggregation_function {
+			return statistic
+		}
+	}
+
+	return nil
+}
+
+// Returns names of all supported statistics
+func supported_statistic_names() []string {
+	names := []string{}
+
+	for _, statistic := range supported_statistics {
+		names = append(names, statistic.name)
+	}
+
+	return names
+}
+
+// Returns list of statistics which we calculate for baselines according to configuration
+// We always calculate p95 because quantile_95 is read by FastNetMon
+func configured_statistics() ([]*traffic_statistic, error) {
+	names := append([]string{"p95"}, configuration.Statistics...)
+
+	// Old aggregation_function option maps to one of our statistics
+	// It was free form Clickhouse function and we must not fail on values which we cannot map
+	if configuration.AggregationFunction != "" {
+		legacy_statistic := find_legacy_statistic(configuration.AggregationFunction)
+
+		if legacy_statistic == nil {
+			fast_logger.Printf("aggregation_function %s is deprecated and has no matching statistic, we ignore it and use statistics option, we support: %s",
+				configuration.AggregationFunction, strings.Join(supported_statistic_names(), ", "))
+		} else {
+			names = append(names, legacy_statistic.name)
+		}
+	}
+
+	statistics := []*traffic_statistic{}
+
+	// Keep order of supported_statistics to have stable query
+	for _, statistic := range supported_statistics {
+		for _, name := range names {
+			if name == statistic.name {
+				statistics = append(statistics, statistic)
+				break
+			}
+		}
+	}
+
+	for _, name := range configuration.Statistics {
+		if find_statistic(name) == nil {
+			return nil, fmt.Errorf("unknown statistic %s, we support: %s", name, strings.Join(supported_statistic_names(), ", "))
+		}
+	}
+
+	// aggregation_function from configuration only selects statistic and we never put it into query
+	for _, statistic := range statistics {
+		if !statistic.is_quantile() && !is_allowed_aggregate_function(statistic.function) {
+			return nil, fmt.Errorf("aggregate function %s of statistic %s is not allowed", statistic.function, statistic.name)
+		}
+	}
+
+	return statistics, nil
+}
+
+// Returns names of statistics
+func statistic_names(statistics []*traffic_statistic) []string {
+	names := []string{}
+
+	for _, statistic := range statistics {
+		names = append(names, statistic.name)
+	}
+
+	return names
+}
+
+// Returns aggregate functions which we use for statistics in same form as in query, e.g. quantiles(0.95,0.99), max
+// We store it in metadata to show how baseline was calculated
+func statistics_aggregation_function(statistics []*traffic_statistic) string {
+	quantile_levels := []string{}
+	functions := []string{}
+
+	for _, statistic := range statistics {
+		if statistic.is_quantile() {
+			quantile_levels = append(quantile_levels, fmt.Sprintf("%g", statistic.quantile_level))
+		} else {
+			functions = append(functions, statistic.function)
+		}
+	}
+
+	if len(quantile_levels) > 0 {
+		functions = append([]string{fmt.Sprintf("quantiles(%s)", strings.Join(quantile_levels, ","))}, functions...)
+	}
+
+	return strings.Join(functions, ", ")
+}
+
+// Generates list of Clickhouse expressions which calculate statistics for column
+// All quantiles are calculated by single quantiles call which returns array
+// When condition is not empty we use only samples which match it
+func generate_statistics_expressions(column string, statistics []*traffic_statistic, condition string) []string {
+	quantile_levels := []string{}
+	expressions := []string{}
+
+	// We use -If combinator for conditions
+	combinator := ""
+	arguments := []string{column}
+
+	if condition != "" {
+		combinator = "If"
+		arguments = append(arguments, condition)
+	}
+
+	for _, statistic := range statistics {
+		if statistic.is_quantile() {
+			quantile_levels = append(quantile_levels, fmt.Sprintf("%g", statistic.quantile_level))
+		} else {
+			expressions = append(expressions, fmt.Sprintf("toInt64(%s)", aggregate_function_call(statistic.function, combinator, nil, arguments...)))
+		}
+	}
+
+	if len(quantile_levels) > 0 {
+		expressions = append([]string{fmt.Sprintf("arrayMap(x -> toInt64(x), %s)", aggregate_function_call("quantiles", combinator, quantile_levels, arguments...))}, expressions...)
+	}
+
+	return expressions
+}
+
+// Returns scan destinations for statistics of column in order of generate_statistics_expressions
+// apply must be called after scan to store values into TrafficValue
+func statistics_scan_destinations(value *TrafficValue, statistics []*traffic_statistic) (destinations []interface{}, apply func()) {
+	quantile_values := []int64{}
+	plain_values := make([]int64, len(statistics))
+
+	have_quantiles := false
+
+	for index, statistic := range statistics {
+		if statistic.is_quantile() {
+			have_quantiles = true
+		} else {
+			destinations = append(destinations, &plain_values[index])
+		}
+	}
+
+	if have_quantiles {
+		destinations = append([]interface{}{&quantile_values}, destinations...)
+	}
+
+	apply = func() {
+		quantile_index := 0
+
+		for index, statistic := range statistics {
+			if !statistic.is_quantile() {
+				statistic.set(value, plain_values[index])
+				continue
+			}
+
+			if quantile_index < len(quantile_values) {
+				statistic.set(value, quantile_values[quantile_index])
+			}
+
+			quantile_index++
+		}
+	}
+
+	return destinations, apply
+}
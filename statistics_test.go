@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindLegacyStatistic(t *testing.T) {
+	test_cases := []struct {
+		aggregation_function string
+		statistic            string
+	}{
+		{"quantile(0.95)", "p95"},
+		{"quantile(0.99)", "p99"},
+		{"quantileExact(0.95)", "p95"},
+		{"quantileTDigest( 0.9 )", "p90"},
+		{"quantile(0.999)", "p99.9"},
+		{"median", "p50"},
+		{"max", "max"},
+		{"avg", "avg"},
+		{"stddevPop", "stddev"},
+		{"quantile(0.8)", ""},
+		{"quantile(abc)", ""},
+		{"min", ""},
+		{"max(bits_incoming)", ""},
+	}
+
+	for _, test_case := range test_cases {
+		statistic := find_legacy_statistic(test_case.aggregation_function)
+
+		name := ""
+
+		if statistic != nil {
+			name = statistic.name
+		}
+
+		if name != test_case.statistic {
+			t.Errorf("aggregation_function %s must map to %q, we have %q", test_case.aggregation_function, test_case.statistic, name)
+		}
+	}
+}
+
+func TestConfiguredStatisticsAcceptLegacyAggregationFunction(t *testing.T) {
+	test_cases := []struct {
+		aggregation_function string
+		statistics           []string
+		expected             string
+	}{
+		{"quantile(0.95)", nil, "p95"},
+		{"median", []string{"max"}, "p50, p95, max"},
+		{"quantileExact(0.99)", nil, "p95, p99"},
+		{"quantile(0.8)", []string{"avg"}, "p95, avg"},
+		{"", nil, "p95"},
+	}
+
+	for _, test_case := range test_cases {
+		configuration = BaselineExporterConfiguration{AggregationFunction: test_case.aggregation_function, Statistics: test_case.statistics}
+
+		statistics, err := configured_statistics()
+
+		if err != nil {
+			t.Errorf("aggregation_function %s must not fail run: %v", test_case.aggregation_function, err)
+			continue
+		}
+
+		names := strings.Join(statistic_names(statistics), ", ")
+
+		if names != test_case.expected {
+			t.Errorf("aggregation_function %s must give statistics %s, we have %s", test_case.aggregation_function, test_case.expected, names)
+		}
+	}
+
+	configuration = BaselineExporterConfiguration{Statistics: []string{"p42"}}
+
+	if _, err := configured_statistics(); err == nil {
+		t.Errorf("Unknown statistic in statistics option must be error")
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Storage where we read FastNetMon configuration and hostgroups and write baselines, top talkers and other results
+// Results are documents with unique name in collection
+type storage_backend interface {
+	// Human readable description for log messages
+	description() string
+
+	// Reads main configuration of FastNetMon
+	read_fastnetmon_configuration(ctx context.Context, fastnetmon_configuration *Fastnetmon_configuration_t) error
+
+	// Reads all hostgroups without any validation
+	read_hostgroups(ctx context.Context) ([]Ban_settings_t, error)
+
+	// Reads document with specified name from collection, returns false when we do not have it
+	read_document(ctx context.Context, collection_name string, name string, document interface{}) (bool, error)
+
+	// Replaces document with specified name in collection or creates it
+	write_document(ctx context.Context, collection_name string, name string, document interface{}) error
+
+	// Returns MongoDB client for features which work only with MongoDB or nil for other backends
+	mongodb_client() *mongo.Client
+
+	close()
+}
+
+// Storage backend which keeps everything in MongoDB like FastNetMon does
+type mongodb_storage struct {
+	client *mongo.Client
+}
+
+// Creates MongoDB storage backend for established connection
+func new_mongodb_storage(mongo_client *mongo.Client) *mongodb_storage {
+	return &mongodb_storage{client: mongo_client}
+}
+
+func (storage *mongodb_storage) description() string {
+	return "MongoDB"
+}
+
+func (storage *mongodb_storage) read_fastnetmon_configuration(ctx context.Context, fastnetmon_configuration *Fastnetmon_configuration_t) error {
+	main_collection := storage.client.Database(global_db_conf.Db_name).Collection("configuration")
+
+	err := main_collection.FindOne(ctx, bson.D{}).Decode(fastnetmon_configuration)
+
+	if err != nil {
+		return fmt.Errorf("Could not retrieve main configuration from MongoDB: %w", err)
+	}
+
+	return nil
+}
+
+func (storage *mongodb_storage) read_hostgroups(ctx context.Context) ([]Ban_settings_t, error) {
+	hostgroups_collection := storage.client.Database(global_db_conf.Db_name).Collection("hostgroups_configuration")
+
+	var host_groups []Ban_settings_t
+
+	cursor, err := hostgroups_collection.Find(ctx, bson.D{})
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load hostgroups from MongoDB: %w", err)
+	}
+
+	if err = cursor.All(ctx, &host_groups); err != nil {
+		return nil, fmt.Errorf("Cannot retrieve hostgroups from MongoDB: %w", err)
+	}
+
+	return host_groups, nil
+}
+
+func (storage *mongodb_storage) read_document(ctx context.Context, collection_name string, name string, document interface{}) (bool, error) {
+	return read_document_by_name(ctx, storage.client, collection_name, name, document)
+}
+
+func (storage *mongodb_storage) write_document(ctx context.Context, collection_name string, name string, document interface{}) error {
+	return replace_document_by_name(ctx, storage.client, collection_name, name, document)
+}
+
+func (storage *mongodb_storage) mongodb_client() *mongo.Client {
+	return storage.client
+}
+
+func (storage *mongodb_storage) close() {
+	disconnect_from_mongodb(storage.client)
+}
+
+// Storage backend which works with directory of JSON files, it allows to run without any database
+// FastNetMon configuration is in configuration.json, hostgroups are in hostgroups_configuration.json
+// and every document is written into <collection>/<name>.json
+type file_storage struct {
+	directory string
+}
+
+// Creates file storage backend for existing directory
+func new_file_storage(directory string) (*file_storage, error) {
+	file_info, err := os.Stat(directory)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot use storage directory: %w", err)
+	}
+
+	if !file_info.IsDir() {
+		return nil, fmt.Errorf("Storage directory %s is not directory", directory)
+	}
+
+	return &file_storage{directory: directory}, nil
+}
+
+func (storage *file_storage) description() string {
+	return "directory " + storage.directory
+}
+
+// Reads JSON file from storage directory
+func (storage *file_storage) read_json_file(path string, document interface{}) error {
+	file_as_array, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(file_as_array, document)
+
+	if err != nil {
+		return fmt.Errorf("Cannot decode %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (storage *file_storage) read_fastnetmon_configuration(ctx context.Context, fastnetmon_configuration *Fastnetmon_configuration_t) error {
+	err := storage.read_json_file(filepath.Join(storage.directory, "configuration.json"), fastnetmon_configuration)
+
+	if err != nil {
+		return fmt.Errorf("Could not read main configuration from %s: %w", storage.description(), err)
+	}
+
+	return nil
+}
+
+func (storage *file_storage) read_hostgroups(ctx context.Context) ([]Ban_settings_t, error) {
+	var host_groups []Ban_settings_t
+
+	err := storage.read_json_file(filepath.Join(storage.directory, "hostgroups_configuration.json"), &host_groups)
+
+	if err != nil {
+		return nil, fmt.Errorf("Cannot load hostgroups from %s: %w", storage.description(), err)
+	}
+
+	return host_groups, nil
+}
+
+// Returns path to file with document, we escape name because hostgroup names can have any symbols
+func (storage *file_storage) document_path(collection_name string, name string) string {
+	return filepath.Join(storage.directory, collection_name, url.PathEscape(name)+".json")
+}
+
+func (storage *file_storage) read_document(ctx context.Context, collection_name string, name string, document interface{}) (bool, error) {
+	path := storage.document_path(collection_name, name)
+
+	if !is_file_exists(path) {
+		return false, nil
+	}
+
+	err := storage.read_json_file(path, document)
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (storage *file_storage) write_document(ctx context.Context, collection_name string, name string, document interface{}) error {
+	path := storage.document_path(collection_name, name)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return fmt.Errorf("Cannot create directory for %s: %w", collection_name, err)
+	}
+
+	json_output, err := json.MarshalIndent(document, "", "  ")
+
+	if err != nil {
+		return fmt.Errorf("Cannot encode JSON: %w", err)
+	}
+
+	// We write temporary file and rename it to avoid partially written documents
+	temporary_path := path + ".tmp"
+
+	err = ioutil.WriteFile(temporary_path, json_output, 0644)
+
+	if err != nil {
+		return fmt.Errorf("Cannot write %s: %w", temporary_path, err)
+	}
+
+	return os.Rename(temporary_path, path)
+}
+
+func (storage *file_storage) mongodb_client() *mongo.Client {
+	return nil
+}
+
+func (storage *file_storage) close() {
+}
+
+// Returns name of storage backend from our configuration or from FastNetMon configuration
+func storage_backend_name() string {
+	if configuration.StorageBackend != "" {
+		return configuration.StorageBackend
+	}
+
+	return global_db_conf.StorageBackend
+}
+
+// Creates storage backend according to configuration, it connects to MongoDB for mongodb backend
+func connect_to_storage(ctx context.Context) (storage_backend, error) {
+	switch storage_backend_name() {
+	case "", "mongodb":
+		mongo_client, err := connect_to_mongodb(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return new_mongodb_storage(mongo_client), nil
+	case "file":
+		if configuration.StorageDirectory == "" {
+			return nil, fmt.Errorf("storage_directory is required for file storage backend")
+		}
+
+		return new_file_storage(configuration.StorageDirectory)
+	default:
+		return nil, fmt.Errorf("Unsupported storage backend %s, we support mongodb and file", storage_backend_name())
+	}
+}